@@ -0,0 +1,224 @@
+/*
+   Copyright (c) Utkan Güngördü <utkan@freeconsole.org>
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as
+   published by the Free Software Foundation; either version 3 or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+
+   GNU General Public License for more details
+
+
+   You should have received a copy of the GNU General Public
+   License along with this program; if not, write to the
+   Free Software Foundation, Inc.,
+   51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package catalog keeps the metadata (size, modification time and content
+// hash) of symlink targets, so that a target can be recognized by its content
+// once the link is broken.
+//
+// A catalogue is stored as JSON Lines, one Entry per line, sorted by path.
+package catalog
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Metadata of a file.
+type Entry struct {
+	Path    string    `json:"path"` // Absolute path of the file
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"sha256"` // SHA-256 of the contents, hex encoded
+}
+
+// Same reports whether the files have the same contents, as far as their
+// sizes and hashes tell.
+func (e *Entry) Same(f *Entry) bool {
+	return e.Size == f.Size && e.Hash == f.Hash
+}
+
+// HashFile returns the hex encoded SHA-256 of the contents of a file.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Stat returns the Entry of a regular file, following symlinks.
+// Returns nil for other kinds of files.
+func Stat(path string) (*Entry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	hash, err := HashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Hash: hash}, nil
+}
+
+// A set of Entries, indexed by path.
+type Catalog struct {
+	entries map[string]*Entry
+	changed bool
+}
+
+func New() *Catalog {
+	return &Catalog{entries: make(map[string]*Entry)}
+}
+
+// Load reads a catalogue. A missing file makes an empty catalogue.
+func Load(path string) (*Catalog, error) {
+	c := New()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in := bufio.NewScanner(f)
+	in.Buffer(nil, 1<<20)
+	for nline := 1; in.Scan(); nline++ {
+		if len(in.Bytes()) == 0 {
+			continue
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(in.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, nline, err)
+		}
+		c.entries[e.Path] = e
+	}
+	return c, in.Err()
+}
+
+// Save writes the catalogue to path, if it has changed since it was loaded.
+// The file is replaced atomically.
+func (c *Catalog) Save(path string) error {
+	if !c.changed {
+		return nil
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, p := range c.Paths() {
+		if err = enc.Encode(c.entries[p]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.changed = false
+	return nil
+}
+
+// Paths returns the paths in the catalogue, sorted.
+func (c *Catalog) Paths() []string {
+	paths := make([]string, 0, len(c.entries))
+	for p := range c.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Returns path absolute and cleaned, as catalogue entries are indexed.
+func key(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// Get returns the Entry for path. A relative path is taken from the
+// working directory.
+func (c *Catalog) Get(path string) (*Entry, bool) {
+	e, ok := c.entries[key(path)]
+	return e, ok
+}
+
+// Put adds or replaces an Entry.
+func (c *Catalog) Put(e *Entry) {
+	c.entries[e.Path] = e
+	c.changed = true
+}
+
+// Update brings the Entry for path up to date, and returns it.
+// The file is hashed again only if its size or modification time changed.
+// Files other than regular ones are left out, returning a nil Entry.
+// A relative path is taken from the working directory.
+func (c *Catalog) Update(path string) (*Entry, error) {
+	path = key(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	if e, ok := c.entries[path]; ok && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) {
+		return e, nil
+	}
+
+	e, err := Stat(path)
+	if err != nil || e == nil {
+		return e, err
+	}
+	c.Put(e)
+	return e, nil
+}
@@ -0,0 +1,197 @@
+package catalog
+
+/*
+ * Snapshots of symlinks: what each link pointed to when the snapshot was
+ * taken, and differences between two snapshots.
+ * */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A symlink, as found when the snapshot was taken.
+type Link struct {
+	Path     string `json:"link"`
+	Target   string `json:"target"`             // As stored in the link
+	Resolved string `json:"resolved,omitempty"` // Empty if the link was broken
+	File     *Entry `json:"file,omitempty"`     // The resolved target, if it was a regular file
+}
+
+func (l *Link) Broken() bool {
+	return l.Resolved == ""
+}
+
+// SnapLink reads the symlink at path. The target is hashed only if hash is
+// set, otherwise File records its size and modification time only.
+func SnapLink(path string, hash bool) (*Link, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Link{Path: abs, Target: target}
+
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return l, nil // Broken
+	}
+	l.Resolved = resolved
+
+	fi, err := os.Stat(resolved)
+	if err != nil || !fi.Mode().IsRegular() {
+		return l, nil
+	}
+	if !hash {
+		l.File = &Entry{Path: resolved, Size: fi.Size(), ModTime: fi.ModTime()}
+		return l, nil
+	}
+	l.File, err = Stat(resolved)
+	return l, err
+}
+
+// WriteSnapshot writes links as JSON Lines, sorted by path.
+func WriteSnapshot(w io.Writer, links []*Link) error {
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, l := range links {
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot. name is used in
+// error messages.
+func ReadSnapshot(r io.Reader, name string) ([]*Link, error) {
+	var links []*Link
+	in := bufio.NewScanner(r)
+	in.Buffer(nil, 1<<20)
+	for nline := 1; in.Scan(); nline++ {
+		if len(in.Bytes()) == 0 {
+			continue
+		}
+		l := new(Link)
+		if err := json.Unmarshal(in.Bytes(), l); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, nline, err)
+		}
+		links = append(links, l)
+	}
+	return links, in.Err()
+}
+
+// LoadSnapshot reads the snapshot in the named file.
+func LoadSnapshot(path string) ([]*Link, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshot(f, path)
+}
+
+// AddLinks adds the hashed targets of the links to the catalogue, both under
+// their resolved path and under the path stored in the link, which is what
+// is left to go by once the link is broken. Entries already in the catalogue
+// are kept.
+func (c *Catalog) AddLinks(links []*Link) {
+	for _, l := range links {
+		if l.File == nil || l.File.Hash == "" {
+			continue
+		}
+		target := l.Target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(l.Path), target)
+		}
+		for _, p := range []string{l.File.Path, filepath.Clean(target)} {
+			if _, ok := c.entries[p]; !ok {
+				e := *l.File
+				e.Path = p
+				c.Put(&e)
+			}
+		}
+	}
+}
+
+// Kinds of Changes between two snapshots.
+const (
+	Added      = "added"
+	Removed    = "removed"
+	Broken     = "broken"
+	Retargeted = "retargeted"
+)
+
+// A difference between two snapshots. Old is nil for added links, New for
+// removed ones.
+type Change struct {
+	Kind     string
+	Old, New *Link
+}
+
+func (c *Change) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("%s %s -> %s", c.Kind, c.New.Path, c.New.Target)
+	case Removed:
+		return fmt.Sprintf("%s %s -> %s", c.Kind, c.Old.Path, c.Old.Target)
+	case Retargeted:
+		return fmt.Sprintf("%s %s: %s -> %s", c.Kind, c.New.Path, c.Old.Target, c.New.Target)
+	}
+	if c.Old.Resolved != c.Old.Target {
+		return fmt.Sprintf("%s %s -> %s (was %s)", c.Kind, c.New.Path, c.New.Target, c.Old.Resolved)
+	}
+	return fmt.Sprintf("%s %s -> %s", c.Kind, c.New.Path, c.New.Target)
+}
+
+// Diff compares two snapshots, and returns the changes sorted by link path.
+// A link that was retargeted is reported as such even if it's now broken.
+func Diff(old, new []*Link) []*Change {
+	before := make(map[string]*Link, len(old))
+	for _, l := range old {
+		before[l.Path] = l
+	}
+	after := make(map[string]*Link, len(new))
+	for _, l := range new {
+		after[l.Path] = l
+	}
+
+	var changes []*Change
+	for _, n := range new {
+		o, ok := before[n.Path]
+		switch {
+		case !ok:
+			changes = append(changes, &Change{Added, nil, n})
+		case o.Target != n.Target:
+			changes = append(changes, &Change{Retargeted, o, n})
+		case !o.Broken() && n.Broken():
+			changes = append(changes, &Change{Broken, o, n})
+		}
+	}
+	for _, o := range old {
+		if _, ok := after[o.Path]; !ok {
+			changes = append(changes, &Change{Removed, o, nil})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].path() < changes[j].path() })
+	return changes
+}
+
+func (c *Change) path() string {
+	if c.New != nil {
+		return c.New.Path
+	}
+	return c.Old.Path
+}
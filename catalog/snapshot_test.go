@@ -0,0 +1,97 @@
+package catalog
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	link := func(path, target, resolved string) *Link {
+		return &Link{Path: path, Target: target, Resolved: resolved}
+	}
+
+	tests := []struct {
+		name     string
+		old, new []*Link
+		want     []string
+	}{
+		{
+			name: "unchanged",
+			old:  []*Link{link("/l/a", "/t/a", "/t/a")},
+			new:  []*Link{link("/l/a", "/t/a", "/t/a")},
+		},
+		{
+			name: "added and removed",
+			old:  []*Link{link("/l/a", "/t/a", "/t/a")},
+			new:  []*Link{link("/l/b", "../t/b", "/t/b")},
+			want: []string{"removed /l/a -> /t/a", "added /l/b -> ../t/b"},
+		},
+		{
+			name: "broken",
+			old:  []*Link{link("/l/a", "/t/a", "/t/a"), link("/l/b", "../t/b", "/t/b")},
+			new:  []*Link{link("/l/a", "/t/a", ""), link("/l/b", "../t/b", "")},
+			want: []string{"broken /l/a -> /t/a", "broken /l/b -> ../t/b (was /t/b)"},
+		},
+		{
+			name: "still broken",
+			old:  []*Link{link("/l/a", "/t/a", "")},
+			new:  []*Link{link("/l/a", "/t/a", "")},
+		},
+		{
+			name: "repaired",
+			old:  []*Link{link("/l/a", "/t/a", "")},
+			new:  []*Link{link("/l/a", "/t/a", "/t/a")},
+		},
+		{
+			// Reported as retargeted even though it's now broken
+			name: "retargeted",
+			old:  []*Link{link("/l/a", "/t/a", "/t/a"), link("/l/b", "/t/b", "/t/b")},
+			new:  []*Link{link("/l/a", "/u/a", "/u/a"), link("/l/b", "/u/b", "")},
+			want: []string{"retargeted /l/a: /t/a -> /u/a", "retargeted /l/b: /t/b -> /u/b"},
+		},
+		{
+			name: "sorted by path",
+			old:  []*Link{link("/l/c", "/t/c", "/t/c"), link("/l/a", "/t/a", "/t/a")},
+			new:  []*Link{link("/l/d", "/t/d", "/t/d"), link("/l/a", "/t/a", ""), link("/l/b", "/t/b", "/t/b")},
+			want: []string{"broken /l/a -> /t/a", "added /l/b -> /t/b", "removed /l/c -> /t/c", "added /l/d -> /t/d"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, c := range Diff(tt.old, tt.new) {
+			got = append(got, c.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Diff = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	links := []*Link{
+		{Path: "/l/b", Target: "/t/b"},
+		{Path: "/l/a", Target: "../t/a", Resolved: "/t/a", File: &Entry{Path: "/t/a", Size: 3, Hash: "abc"}},
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, links); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSnapshot(&buf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0].Path != "/l/a" || read[1].Path != "/l/b" {
+		t.Fatalf("ReadSnapshot = %v, want the links sorted by path", read)
+	}
+	if changes := Diff(links, read); len(changes) != 0 {
+		t.Errorf("Diff after a round trip = %v, want none", changes)
+	}
+	if read[1].File != nil || read[0].File.Hash != "abc" {
+		t.Errorf("files not kept: %+v, %+v", read[0].File, read[1].File)
+	}
+
+	if _, err := ReadSnapshot(bytes.NewBufferString("{}\n\nnot json\n"), "bad"); err == nil || err.Error()[:6] != "bad:3:" {
+		t.Errorf("ReadSnapshot of a bad line: %v, want an error on bad:3", err)
+	}
+}
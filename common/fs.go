@@ -5,6 +5,9 @@ package common
  * */
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -64,3 +67,86 @@ func MakeAbsolute(filename string, dirname string) string {
 	}
 	return filename
 }
+
+// ReplaceSymlink makes newname a symlink to target, in place of the symlink
+// oldname. The new link is made under a temporary name in the same directory
+// and renamed over newname, so that the link never goes missing; if anything
+// goes wrong, oldname is left as it was.
+// If newname differs from oldname, it must not exist, and oldname is removed
+// once newname is in place.
+func ReplaceSymlink(oldname, newname, target string) error {
+	dir := filepath.Dir(newname)
+
+	// A short name, as newname's may already be as long as names can be
+	var tmp string
+	for i := 0; ; i++ {
+		tmp = filepath.Join(dir, fmt.Sprintf(".symutils-%08x.tmp", rand.Uint32()))
+		err := os.Symlink(target, tmp)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) || i == 100 {
+			return err
+		}
+	}
+
+	if newname == oldname {
+		if err := os.Rename(tmp, newname); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+
+	// link(2) doesn't replace newname if it exists, unlike rename(2).
+	err := os.Link(tmp, newname)
+	os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+	return os.Remove(oldname)
+}
+
+// Usage string for the -style flag of the commands.
+const LinkStyleUsage = "How new symlink targets are written: preserve (relative if the old target was relative, absolute otherwise), relative (to the directory of the symlink) or absolute."
+
+// CheckLinkStyle returns an error if style isn't one of LinkStyleUsage.
+func CheckLinkStyle(style string) error {
+	switch style {
+	case "preserve", "relative", "absolute":
+		return nil
+	}
+	return errors.New("Unknown link style: " + style)
+}
+
+// Resolves the symlinks in the directory part of path, if it exists.
+func realDir(path string) string {
+	dir, base := filepath.Split(path)
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		return filepath.Join(real, base)
+	}
+	return filepath.Clean(path)
+}
+
+// LinkTarget returns target as it is to be written in the symlink linkname,
+// whose previous target was oldtarget, according to style (see
+// LinkStyleUsage). Relative targets are relative to the directory of
+// linkname, as in symlinks.
+func LinkTarget(style, linkname, oldtarget, target string) (string, error) {
+	linkdir := filepath.Dir(MakeAbsolute(linkname, ""))
+	target = MakeAbsolute(target, linkdir)
+
+	if err := CheckLinkStyle(style); err != nil {
+		return "", err
+	}
+	if style == "absolute" || (style == "preserve" && filepath.IsAbs(oldtarget)) {
+		return target, nil
+	}
+
+	// The link's directory is resolved as a whole: a relative target is
+	// followed from where the directory really is
+	if real, err := filepath.EvalSymlinks(linkdir); err == nil {
+		linkdir = real
+	}
+	return filepath.Rel(linkdir, realDir(target))
+}
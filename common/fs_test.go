@@ -0,0 +1,127 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns the names in dir, and the targets of the symlinks among them.
+func listLinks(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]string)
+	for _, e := range entries {
+		links[e.Name()], _ = os.Readlink(filepath.Join(dir, e.Name()))
+	}
+	return links
+}
+
+func TestReplaceSymlink(t *testing.T) {
+	long := strings.Repeat("x", 250)
+	tests := []struct {
+		name             string
+		links            map[string]string // Before
+		oldname, newname string
+		err              bool
+		want             map[string]string // After
+	}{
+		{
+			name:    "same name",
+			links:   map[string]string{"l": "a"},
+			oldname: "l", newname: "l",
+			want: map[string]string{"l": "b"},
+		},
+		{
+			name:    "long name",
+			links:   map[string]string{long: "a"},
+			oldname: long, newname: long,
+			want: map[string]string{long: "b"},
+		},
+		{
+			name:    "rename",
+			links:   map[string]string{"l": "a"},
+			oldname: "l", newname: "m",
+			want: map[string]string{"m": "b"},
+		},
+		{
+			name:    "rename onto an existing name",
+			links:   map[string]string{"l": "a", "m": "c"},
+			oldname: "l", newname: "m",
+			err:  true,
+			want: map[string]string{"l": "a", "m": "c"},
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for name, target := range tt.links {
+			if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := ReplaceSymlink(filepath.Join(dir, tt.oldname), filepath.Join(dir, tt.newname), "b")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: ReplaceSymlink error %v, want error %v", tt.name, err, tt.err)
+		}
+		// No temporary link left behind either
+		if got := listLinks(t, dir); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: links %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLinkTarget(t *testing.T) {
+	dir := t.TempDir()
+	// tags is a symlink to a deeper directory, as in a tag tree
+	for _, d := range []string{"data", "deep/er/tags"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("deep/er/tags", filepath.Join(dir, "tags")); err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, "data", "f")
+	tests := []struct {
+		style, linkname, oldtarget, target string
+		want                               string
+	}{
+		{"absolute", "deep/l", "../old", data, data},
+		{"absolute", "deep/l", "/old", "../data/f", data},
+		{"relative", "deep/l", "/old", data, "../data/f"},
+		{"relative", "deep/l", "../old", "../data/f", "../data/f"},
+		{"relative", "tags/l", "/old", data, "../../../data/f"},
+		{"preserve", "deep/l", "/old", data, data},
+		{"preserve", "deep/l", "../old", data, "../data/f"},
+		{"preserve", "tags/l", "../old", data, "../../../data/f"},
+	}
+	for _, tt := range tests {
+		got, err := LinkTarget(tt.style, filepath.Join(dir, tt.linkname), tt.oldtarget, tt.target)
+		if err != nil || got != tt.want {
+			t.Errorf("LinkTarget(%s, %s, %s, %s) = %s, %v, want %s", tt.style, tt.linkname, tt.oldtarget, tt.target, got, err, tt.want)
+		}
+	}
+
+	if _, err := LinkTarget("bogus", filepath.Join(dir, "deep/l"), "/old", data); err == nil {
+		t.Error("LinkTarget with an unknown style: no error")
+	}
+}
+
+func TestCheckLinkStyle(t *testing.T) {
+	for _, style := range []string{"preserve", "relative", "absolute"} {
+		if err := CheckLinkStyle(style); err != nil {
+			t.Errorf("CheckLinkStyle(%s): %v", style, err)
+		}
+	}
+	for _, style := range []string{"", "Relative", "abs"} {
+		if err := CheckLinkStyle(style); err == nil {
+			t.Errorf("CheckLinkStyle(%q): no error", style)
+		}
+	}
+}
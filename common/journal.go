@@ -0,0 +1,225 @@
+package common
+
+/*
+ * Journal of the changes made to symlinks, so that they can be undone.
+ * */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Usage string for the -journal flag of the commands.
+const JournalUsage = "Append-only journal recording every symlink changed, so that the changes can be undone with symundo(1). Empty disables journaling."
+
+// A change made to a symlink.
+// NewPath is empty if the link was removed, OldPath if it was created.
+//
+// A change is journaled before it's made, then marked as done by a line with
+// the same Run and Seq, and Done set. A change without that mark is Pending:
+// the command stopped or failed before it could tell whether it was made.
+type JournalEntry struct {
+	Time      time.Time `json:"time"`
+	Run       string    `json:"run"` // Identifies the run of the command that made the change
+	Tool      string    `json:"tool"`
+	Seq       int       `json:"seq,omitempty"` // Number of the change in the run, zero in older journals
+	Done      bool      `json:"done,omitempty"`
+	OldPath   string    `json:"old_path,omitempty"`
+	OldTarget string    `json:"old_target,omitempty"`
+	NewPath   string    `json:"new_path,omitempty"`
+	NewTarget string    `json:"new_target,omitempty"`
+	Pending   bool      `json:"-"` // Set by ReadJournal
+}
+
+// Returns the default journal, $XDG_STATE_HOME/symutils/journal.
+func DefaultJournalPath() string {
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(state, "symutils", "journal")
+}
+
+// Appends JournalEntries to a file, one JSON object per line.
+// A nil Journal records nothing.
+type Journal struct {
+	tool, run string
+	seq       int // Of the last change
+	f         *os.File
+}
+
+// OpenJournal opens the journal at path for appending the changes made by
+// tool, creating it if need be. Returns a nil Journal if path is empty.
+func OpenJournal(path, tool string) (*Journal, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	run := fmt.Sprintf("%s-%d", time.Now().Format("20060102T150405"), os.Getpid())
+	return &Journal{tool: tool, run: run, f: f}, nil
+}
+
+// Begin appends a change about to be made to the journal, and syncs it to
+// the disk. Paths are made absolute. The change must not be made if Begin
+// fails, and should be marked with Done once it's made.
+func (j *Journal) Begin(oldPath, oldTarget, newPath, newTarget string) (*JournalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	j.seq++
+	e := &JournalEntry{Time: time.Now(), Run: j.run, Tool: j.tool, Seq: j.seq, OldTarget: oldTarget, NewTarget: newTarget}
+	if oldPath != "" {
+		e.OldPath = MakeAbsolute(oldPath, "")
+	}
+	if newPath != "" {
+		e.NewPath = MakeAbsolute(newPath, "")
+	}
+	return e, j.write(e)
+}
+
+// Done marks the change journaled by Begin as made.
+func (j *Journal) Done(e *JournalEntry) error {
+	if j == nil || e == nil {
+		return nil
+	}
+	return j.write(&JournalEntry{Time: time.Now(), Run: e.Run, Tool: e.Tool, Seq: e.Seq, Done: true})
+}
+
+func (j *Journal) write(e *JournalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// ReadJournal reads all the changes in a journal, oldest first, setting
+// Pending for those not marked as done. An incomplete last line, left by a
+// crash, is ignored.
+func ReadJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	type change struct {
+		run string
+		seq int
+	}
+	pending := make(map[change]int) // Index in entries of the changes not done yet
+	var bad error                   // Error on the previous line, fatal unless it's the last one
+	in := bufio.NewScanner(f)
+	in.Buffer(nil, 1<<20)
+	for nline := 1; in.Scan(); nline++ {
+		if bad != nil {
+			return nil, bad
+		}
+		if len(in.Bytes()) == 0 {
+			continue
+		}
+
+		var e JournalEntry
+		if err := json.Unmarshal(in.Bytes(), &e); err != nil {
+			bad = fmt.Errorf("%s:%d: %v", path, nline, err)
+			continue
+		}
+
+		key := change{e.Run, e.Seq}
+		if e.Done {
+			if i, ok := pending[key]; ok {
+				entries[i].Pending = false
+				delete(pending, key)
+			}
+			continue
+		}
+		if e.Seq != 0 {
+			e.Pending = true
+			pending[key] = len(entries)
+		}
+		entries = append(entries, e)
+	}
+	if bad != nil {
+		Warnln("Ignoring incomplete last entry:", bad)
+	}
+	return entries, in.Err()
+}
+
+// Check reports whether the link is still as the change left it: NewPath
+// must point to NewTarget, and OldPath must not exist (unless it's the same
+// as NewPath).
+func (e *JournalEntry) Check() error {
+	if e.NewPath != "" {
+		target, err := os.Readlink(e.NewPath)
+		if err != nil {
+			return err
+		}
+		if target != e.NewTarget {
+			return fmt.Errorf("%s has changed since, it points to %s instead of %s", e.NewPath, target, e.NewTarget)
+		}
+	}
+	if e.OldPath != "" && e.OldPath != e.NewPath {
+		if _, err := os.Lstat(e.OldPath); err == nil {
+			return fmt.Errorf("%s has been created since", e.OldPath)
+		}
+	}
+	return nil
+}
+
+// Unmade reports whether the link is still as it was before the change, as
+// may be the case for a Pending change.
+func (e *JournalEntry) Unmade() bool {
+	if e.OldPath != "" {
+		if target, err := os.Readlink(e.OldPath); err != nil || target != e.OldTarget {
+			return false
+		}
+	}
+	if e.NewPath != "" && e.NewPath != e.OldPath {
+		if _, err := os.Lstat(e.NewPath); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Undo reverts the change, if Check finds nothing wrong.
+func (e *JournalEntry) Undo() error {
+	if err := e.Check(); err != nil {
+		return err
+	}
+
+	switch {
+	case e.OldPath == "":
+		return os.Remove(e.NewPath)
+	case e.NewPath == "":
+		return os.Symlink(e.OldTarget, e.OldPath)
+	}
+	return ReplaceSymlink(e.NewPath, e.OldPath, e.OldTarget)
+}
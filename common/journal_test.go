@@ -0,0 +1,58 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalPending(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal")
+	link := filepath.Join(dir, "l")
+	if err := os.Symlink("a", link); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := OpenJournal(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Made and marked as done
+	e, err := j.Begin(link, "a", link, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplaceSymlink(link, link, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Done(e); err != nil {
+		t.Fatal(err)
+	}
+	// Never made
+	if _, err := j.Begin(link, "b", link, "c"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	entries, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ReadJournal: %d entries, want 2", len(entries))
+	}
+	if entries[0].Pending || entries[0].Check() != nil {
+		t.Errorf("made change: pending %v, check %v", entries[0].Pending, entries[0].Check())
+	}
+	if !entries[1].Pending || !entries[1].Unmade() {
+		t.Errorf("change never made: pending %v, unmade %v", entries[1].Pending, entries[1].Unmade())
+	}
+
+	if err := entries[0].Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := os.Readlink(link); target != "a" {
+		t.Errorf("undone link points to %s, want a", target)
+	}
+}
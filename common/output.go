@@ -0,0 +1,104 @@
+package common
+
+/*
+ * Output of the listing commands in various formats.
+ * */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Usage string for the -format flag of the commands.
+const OutputFormatUsage = "Output format: plain (one path per line), null (NUL terminated paths, same as -0), json (JSON Lines, one object per entry) or csv (with path,target,size,action header)."
+
+// An entry in the output of a command.
+// Fields that do not apply to a command (or entry) are left empty.
+type Record struct {
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"` // Target of the symlink
+	Size   int64  `json:"size,omitempty"`   // Size of the file in bytes, zero if unknown
+	Action string `json:"action,omitempty"` // What's been done with the file, e.g. rm, ln, replace
+}
+
+type OutputFormat int
+
+const (
+	PlainOutput OutputFormat = iota
+	NullOutput
+	JSONOutput
+	CSVOutput
+)
+
+var outputFormats = map[string]OutputFormat{
+	"plain": PlainOutput,
+	"null":  NullOutput,
+	"json":  JSONOutput,
+	"csv":   CSVOutput,
+}
+
+// Writes Records to an io.Writer in the requested format.
+// Plain and null formats write paths only.
+type Output struct {
+	Format OutputFormat
+
+	w    io.Writer
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+// NewOutput creates an Output writing to w.
+// format is one of plain, null, json or csv; nullSep (the -0 flag of the
+// commands) turns the plain format into null.
+func NewOutput(w io.Writer, format string, nullSep bool) (*Output, error) {
+	f, ok := outputFormats[format]
+	if !ok {
+		return nil, errors.New("Unknown output format: " + format)
+	}
+	if nullSep && f == PlainOutput {
+		f = NullOutput
+	}
+
+	o := &Output{Format: f, w: w}
+	switch f {
+	case JSONOutput:
+		o.json = json.NewEncoder(w)
+	case CSVOutput:
+		o.csv = csv.NewWriter(w)
+		if err := o.csv.Write([]string{"path", "target", "size", "action"}); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Structured reports whether the format carries all fields of a Record,
+// rather than paths only.
+func (o *Output) Structured() bool {
+	return o.Format == JSONOutput || o.Format == CSVOutput
+}
+
+// Write writes a single Record.
+func (o *Output) Write(r Record) error {
+	switch o.Format {
+	case NullOutput:
+		_, err := fmt.Fprint(o.w, r.Path, "\x00")
+		return err
+	case JSONOutput:
+		return o.json.Encode(r)
+	case CSVOutput:
+		size := ""
+		if r.Size != 0 {
+			size = fmt.Sprint(r.Size)
+		}
+		o.csv.Write([]string{r.Path, r.Target, size, r.Action})
+		o.csv.Flush()
+		return o.csv.Error()
+	}
+
+	_, err := fmt.Fprintln(o.w, r.Path)
+	return err
+}
@@ -15,7 +15,8 @@ func PrintVersion(pkg string, version string, author string) {
 }
 
 func PrintHelp(pkg string, version string, about string, usage string) {
-	fmt.Println(pkg, version, "\n")
+	fmt.Println(pkg, version)
+	fmt.Println()
 	fmt.Println(about)
 	fmt.Println("Usage:")
 	fmt.Println("\t", usage)
@@ -36,10 +36,16 @@ var (
 	yesToAll = flag.Bool("Y", false, "Assume yes to all y/n questions (they appear before making changes in the filesystem)")
 	action   = flag.String("action", "none", "What to do with duplicates? Valid choices are none (nothing), rm (remove), ln (link back to origin).")
 
+	nullSep      = flag.Bool("0", false, "List duplicates separated with NUL instead of the human readable listing.")
+	outputFormat = flag.String("format", "plain", OutputFormatUsage+" json and csv also report the files removed or linked.")
+
 	verbose = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
 )
 
-var db *locate.DB
+var (
+	db  *locate.DB
+	out *Output
+)
 
 const (
 	pkg, version, author, about, usage string = "dups", VERSION, "Utkan Güngördü",
@@ -83,6 +89,11 @@ func init() {
 	}
 	minSize = filesize(int64(*_minSize) * multiplier)
 
+	var err error
+	if out, err = NewOutput(os.Stdout, *outputFormat, *nullSep); err != nil {
+		log.Fatal(err)
+	}
+
 	options := locate.Options{
 		IgnoreCase: *ignoreCase,
 		Basename:   false,
@@ -95,28 +106,39 @@ func init() {
 		Root:       *root,
 	}
 
-	var err error
 	db, err = locate.NewDB(strings.Split(*dbFiles, ":"), &options)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func rm(path string) error {
-	if okay("Really remove the file?: %s", path) {
-		return os.Remove(path)
+// Removes the file, returns whether it's been removed.
+func rm(path string) (bool, error) {
+	if !okay("Really remove the file?: %s", path) {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
 	}
 	Logln("Removed file: ", path)
-	return nil
+	if out.Structured() {
+		out.Write(Record{Path: path, Action: "rm"})
+	}
+	return true, nil
 }
 
 func rmAndLink(path, newtarget string) error {
-	if err := rm(path); err != nil {
+	if removed, err := rm(path); !removed {
 		return err
 	}
 
 	if okay("Okay to create the symlink?: %s -> %s", path, newtarget) {
-		return os.Symlink(newtarget, path)
+		if err := os.Symlink(newtarget, path); err != nil {
+			return err
+		}
+		if out.Structured() {
+			out.Write(Record{Path: path, Target: newtarget, Action: "ln"})
+		}
 	}
 	return nil
 }
@@ -125,7 +147,9 @@ func handleDups(paths []string) {
 	if len(paths) < 2 {
 		return
 	}
-	fmt.Println()
+	if out.Format == PlainOutput {
+		fmt.Println()
+	}
 	orig, cancel := Choose("Which of these should be considered as the origin?", paths)
 	if cancel {
 		Logln("User cancel")
@@ -138,7 +162,7 @@ func handleDups(paths []string) {
 			if i == orig {
 				continue
 			}
-			if err := rm(paths[i]); err != nil {
+			if _, err := rm(paths[i]); err != nil {
 				Warnln(err)
 			}
 		}
@@ -197,7 +221,11 @@ func main() {
 			}
 
 			for _, path := range paths {
-				fmt.Println("[", size, "B,", filesize(size), *unit, "]", path)
+				if out.Format == PlainOutput {
+					fmt.Println("[", size, "B,", filesize(size), *unit, "]", path)
+				} else {
+					out.Write(Record{Path: path, Size: size})
+				}
 			}
 
 			handleDups(paths)
@@ -10,8 +10,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // A list paths, indexed by a string.
@@ -21,10 +23,35 @@ type PathList map[string][]string
 type DB struct {
 	dbFilenames []string // Databases
 	files       []string // Union of files listed in db files
+	segments    []int    // With several databases, files[segments[i-1]:segments[i]] (sorted) came from the ith one
 	options     Options
 
 	basenames  PathList // A map of file basenames -> path of files with that basename
 	hasmapLock sync.Mutex
+
+	stats []DBStats // Statistics for each database file, in the order they are read
+}
+
+// Statistics about a database file, gathered while reading it.
+type DBStats struct {
+	Filename  string
+	Format    string        // Database format, "mlocate" or "unknown"
+	Root      string        // Root directory the database was created for
+	Dirs      int           // Number of directories in the database
+	Files     int           // Number of non-directory entries in the database
+	PathBytes int64         // Total length of path names of the entries
+	Size      int64         // Size of the database file in bytes
+	LoadTime  time.Duration // Time it took to read and parse the file
+}
+
+// Len returns the number of files listed in the database.
+func (db *DB) Len() int {
+	return len(db.files)
+}
+
+// Stats returns statistics about each database file.
+func (db *DB) Stats() []DBStats {
+	return db.stats
 }
 
 func (db *DB) bakeBasenames() error {
@@ -53,29 +80,50 @@ func (db *DB) readDBs() error {
 		return nil
 	}
 
+	// Files listed in more than one database are attributed to the first one.
 	fmap := make(map[string]struct{})
 	var elem struct{}
+	var files []string
+	db.segments = make([]int, 0, len(db.dbFilenames))
 	for _, dbf := range db.dbFilenames {
 		nametab, err := db.readDB(dbf)
+		start := len(files)
 		for _, f := range nametab {
-			fmap[f] = elem
+			if _, ok := fmap[f]; !ok {
+				fmap[f] = elem
+				files = append(files, f)
+			}
 		}
+		sort.Strings(files[start:])
+		db.segments = append(db.segments, len(files))
 		if err != nil {
 			return err
 		} // FIXME(utkan): We can move on to the next file instead of giving up
 	}
 
-	files := make([]string, len(fmap))
-	i := 0
-	for f, _ := range fmap {
-		files[i] = f
-		i++
-	}
-	//sort.SortStrings(files)
 	db.files = files
 	return nil
 }
 
+// Source returns the name of the database file listing path, or "" if it's
+// not in the databases. With a single database, its name is returned without
+// looking path up.
+func (db *DB) Source(path string) string {
+	if len(db.dbFilenames) == 1 {
+		return db.dbFilenames[0]
+	}
+
+	start := 0
+	for i, end := range db.segments {
+		segment := db.files[start:end]
+		if j := sort.SearchStrings(segment, path); j < len(segment) && segment[j] == path {
+			return db.dbFilenames[i]
+		}
+		start = end
+	}
+	return ""
+}
+
 func setgid() error {
 	exe, err := exec.LookPath(os.Args[0])
 	if err != nil {
@@ -95,6 +143,13 @@ func setgid() error {
 func (db *DB) readDB(filename string) (r []string, err error) {
 	var fb []byte
 
+	st := DBStats{Filename: filename, Format: "unknown"}
+	t0 := time.Now()
+	defer func() {
+		st.LoadTime = time.Now().Sub(t0)
+		db.stats = append(db.stats, st)
+	}()
+
 	func() {
 		gid := syscall.Getgid()
 		if setgid() != nil {
@@ -106,15 +161,17 @@ func (db *DB) readDB(filename string) (r []string, err error) {
 	if err != nil {
 		return
 	}
+	st.Size = int64(len(fb))
 
 	if bytes.Compare(fb[0:8], []byte("\x00mlocate")) == 0 {
-		return db.readMlocateDB(fb)
+		st.Format = "mlocate"
+		return db.readMlocateDB(fb, &st)
 	}
 
 	return
 }
 
-func (db *DB) readMlocateDB(fb []byte) (nametab []string, e error) {
+func (db *DB) readMlocateDB(fb []byte, st *DBStats) (nametab []string, e error) {
 	/*
 		8 bytes magic
 		4 bytes configuration block size (BE)
@@ -140,6 +197,7 @@ func (db *DB) readMlocateDB(fb []byte) (nametab []string, e error) {
 
 	//visibility := fb[13] == 0
 	rootpath, rem := nextCstr(fb[16:])
+	st.Root = rootpath
 
 	stampsize := 16
 
@@ -165,13 +223,18 @@ func (db *DB) readMlocateDB(fb []byte) (nametab []string, e error) {
 			}
 			curDir = name
 			dirNameNow = false
+			st.Dirs++
 		} else {
 			if alwaysOk || ok {
 				nametab = append(nametab, curDir+"/"+name)
 			}
+			st.PathBytes += int64(len(curDir) + 1 + len(name))
 		}
 		ftype := rem[0]
 		rem = rem[1:]
+		if ftype == 0 {
+			st.Files++
+		}
 
 		if len(rem) == 0 {
 			break
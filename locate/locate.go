@@ -24,11 +24,14 @@
 package locate
 
 import (
+	"context"
 	"errors"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"symutils/fuzzy"
+	"sync"
+	"sync/atomic"
 )
 
 // BUG(utkan): Cannot change IgnoreCase after creating DB.
@@ -39,99 +42,181 @@ import (
 
 // TODO(utkan): Implement a function to report the DB type.
 
-func (db *DB) locate(pattern string, ch chan string, match func(n string, h string) bool) (e error) {
-	n := uint(0)
-	nworkers := uint(0)
+// Progress of a search, which can be read while searching.
+type Progress struct {
+	scanned int64
+	total   int64
+}
+
+// Scanned returns the number of database entries examined so far.
+func (p *Progress) Scanned() int {
+	return int(atomic.LoadInt64(&p.scanned))
+}
 
-	worker := func(files []string, wch chan string, match func(n string, h string) bool) {
-		defer func() {
-			nworkers--
-			if nworkers == 0 {
-				close(wch)
+// Total returns the number of database entries to examine.
+func (p *Progress) Total() int {
+	return int(atomic.LoadInt64(&p.total))
+}
+
+func (p *Progress) add(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.scanned, int64(n))
+	}
+}
+
+func (p *Progress) setTotal(n int) {
+	if p != nil {
+		atomic.StoreInt64(&p.scanned, 0)
+		atomic.StoreInt64(&p.total, int64(n))
+	}
+}
+
+// Workers check for cancellation and report progress after this many entries.
+const progressBlock = 4096
+
+func (db *DB) locate(ctx context.Context, pattern string, ch chan string, match func(n string, h string) bool, options *Options, progress *Progress) error {
+	// Cancelled when the search is over, including when MaxMatches is reached
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		n       uint64
+		errOnce sync.Once
+		e       error
+		wg      sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { e = err })
+		cancel()
+	}
+
+	progress.setTotal(len(db.files))
+	wch := make(chan string)
+	worker := func(files []string) {
+		defer wg.Done()
+
+		// Entries up to last were added to progress. When the search stops
+		// early, the rest count as done as well.
+		last := 0
+		defer func() { progress.add(len(files) - last) }()
+
+		for i, f := range files {
+			if i%progressBlock == 0 {
+				progress.add(i - last)
+				last = i
+				if stop.Err() != nil {
+					return
+				}
 			}
-		}()
 
-		for _, f := range files {
-			haystack := bakeName(f, &db.options)
+			haystack := bakeName(f, options)
 
 			if match(pattern, haystack) == false {
 				continue
 			}
 
-			if db.options.Basename {
+			if options.Basename {
 				if filepath.Base(f) != filepath.Base(pattern) {
 					continue
 				}
 			}
-			ok, err := matchOkay(f, &db.options)
+			ok, err := matchOkay(f, options)
 			if err != nil {
-				e = err
+				fail(err)
 				return
 			}
-			if ok {
-				wch <- f
-
-				n++
+			if !ok {
+				continue
+			}
+			if options.MaxMatches > 0 && atomic.AddUint64(&n, 1) > uint64(options.MaxMatches) {
+				cancel()
+				return
 			}
-			if db.options.MaxMatches > 0 && n >= db.options.MaxMatches {
+			select {
+			case wch <- f:
+			case <-stop.Done():
 				return
-			} // FIXME(utkan):
+			}
 		}
 	}
 
-	nblock := uint(len(db.files)) / db.options.NWorkers
-	nrem := uint(len(db.files)) % db.options.NWorkers
-
-	nworkers = db.options.NWorkers
-	if nrem != 0 {
-		nworkers++
-	} // BUG(utkan): An extra worker in locate() might cause performance loss depending on GOMAXPROCS
+	nworkers := db.options.NWorkers
+	nblock := uint(len(db.files)) / nworkers
+	nrem := uint(len(db.files)) % nworkers
 
-	wch := make(chan string)
-	for i := uint(0); i < db.options.NWorkers; i++ {
-		go worker(db.files[i*nblock:(i+1)*nblock], wch, match)
+	// BUG(utkan): An extra worker in locate() might cause performance loss depending on GOMAXPROCS
+	for i := uint(0); i < nworkers; i++ {
+		wg.Add(1)
+		go worker(db.files[i*nblock : (i+1)*nblock])
 	}
 	if nrem > 0 {
-		go worker(db.files[db.options.NWorkers*nblock:], wch, match)
+		wg.Add(1)
+		go worker(db.files[nworkers*nblock:])
 	}
+	go func() {
+		wg.Wait()
+		close(wch)
+	}()
 
 	for f := range wch {
-		ch <- f
+		select {
+		case ch <- f:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	return
+	if e != nil {
+		return e
+	}
+	return ctx.Err()
 }
 
 // Uses the built-in map to look-up files.
 // If NewDB was not called with HashMap option enabled, the lookup table
 // will be created on demand.
 func (db *DB) LocateHashMap(pattern string, ch chan string) error {
+	return db.locateHashMap(context.Background(), pattern, ch, &db.options, nil)
+}
+
+// The lookup table is built with the options of the DB, so IgnoreCase and
+// StripExtension of the given options have no effect.
+func (db *DB) locateHashMap(ctx context.Context, pattern string, ch chan string, options *Options, progress *Progress) error {
 	if len(db.basenames) == 0 {
 		if err := db.bakeBasenames(); err != nil {
 			return err
 		}
 	}
 
+	// The lock is held only while looking up: the consumer may take its time
+	// with the matches, and bakeBasenames makes new slices rather than
+	// changing those already handed out.
 	db.hasmapLock.Lock()
-	defer db.hasmapLock.Unlock()
-
 	matches, ok := db.basenames[bakeName(filepath.Base(pattern), &db.options)]
+	db.hasmapLock.Unlock()
+
+	progress.setTotal(len(matches))
 	if !ok {
 		return nil // no matches
 	}
 
 	n := uint(0)
 	for _, m := range matches {
-		mOK, err := matchOkay(m, &db.options)
+		progress.add(1)
+		mOK, err := matchOkay(m, options)
 		if err != nil {
 			return err
 		}
 
 		if mOK {
-			ch <- m
+			select {
+			case ch <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 
 			n++
-			if db.options.MaxMatches > 0 && n >= db.options.MaxMatches {
+			if options.MaxMatches > 0 && n >= options.MaxMatches {
 				return nil
 			}
 		}
@@ -144,27 +229,33 @@ func (db *DB) LocateHashMap(pattern string, ch chan string) error {
 // Matching entries in the database are returned via channel ch.
 // LocateWildcard forces StripPath option, even when not enabled.
 func (db *DB) LocateWildcard(pattern string, ch chan string) (err error) {
-	pattern = bakeName(pattern, &db.options)
+	return db.locateWildcard(context.Background(), pattern, ch, &db.options, nil)
+}
 
+func (db *DB) locateWildcard(ctx context.Context, pattern string, ch chan string, options *Options, progress *Progress) (err error) {
 	// With recent changes, filepath.Match behaves like fnmatch(3) with FNM_PATHNAME
 	// enabled. We thus need StripPath
-	stripPath := db.options.StripPath
-	db.options.StripPath = true
+	wildcardOptions := *options
+	wildcardOptions.StripPath = true
+
+	pattern = bakeName(pattern, &wildcardOptions)
 
 	match := func(n string, h string) bool {
 		m, _ := filepath.Match(n, h)
 		return m
 	}
 
-	err = db.locate(pattern, ch, match)
-	db.options.StripPath = stripPath
-	return
+	return db.locate(ctx, pattern, ch, match, &wildcardOptions, progress)
 }
 
 // Searches for entries that mathch filename pattern fn, using regexp.MatchString
 // Matching entries in the database are returned via channel ch.
 func (db *DB) LocateRegexp(pattern string, ch chan string) (err error) {
-	pattern = bakeName(pattern, &db.options)
+	return db.locateRegexp(context.Background(), pattern, ch, &db.options, nil)
+}
+
+func (db *DB) locateRegexp(ctx context.Context, pattern string, ch chan string, options *Options, progress *Progress) (err error) {
+	pattern = bakeName(pattern, options)
 
 	var re *regexp.Regexp
 	re, err = regexp.Compile(pattern)
@@ -176,28 +267,49 @@ func (db *DB) LocateRegexp(pattern string, ch chan string) (err error) {
 		return re.MatchString(h)
 	}
 
-	return db.locate(pattern, ch, match)
+	return db.locate(ctx, pattern, ch, match, options, progress)
 }
 
 // Performs a fuzzy search in the database against name, with given cost values and threshold Levenshtein distance.
 // Matching entries in the database are returned via channel ch.
 func (db *DB) LocateLevenshtein(name string, ch chan string) (err error) {
-	name = bakeName(name, &db.options)
+	return db.locateLevenshtein(context.Background(), name, ch, &db.options, nil)
+}
+
+func (db *DB) locateLevenshtein(ctx context.Context, name string, ch chan string, options *Options, progress *Progress) (err error) {
+	name = bakeName(name, options)
 	_, name = filepath.Split(name) // Work only with basename
 
 	match := func(n string, h string) bool {
-		return fuzzy.Levenshtein(n, h, &db.options.LevenshteinCost) <= db.options.LevenshteinThreshold
+		return fuzzy.Levenshtein(n, h, &options.LevenshteinCost) <= options.LevenshteinThreshold
 	}
-	return db.locate(name, ch, match)
+	return db.locate(ctx, name, ch, match, options, progress)
 }
 
 // Locates the files with name as a substring. Uses strings.Contains.
 func (db *DB) LocateSubstring(name string, ch chan string) (err error) {
-	name = bakeName(name, &db.options)
+	return db.locateSubstring(context.Background(), name, ch, &db.options, nil)
+}
+
+func (db *DB) locateSubstring(ctx context.Context, name string, ch chan string, options *Options, progress *Progress) (err error) {
+	name = bakeName(name, options)
 	match := func(n string, h string) bool {
 		return strings.Contains(h, n)
 	}
-	return db.locate(name, ch, match)
+	return db.locate(ctx, name, ch, match, options, progress)
+}
+
+// Names of the search methods, as accepted by Locate.
+var Methods = []string{"wildcard", "substring", "levenshtein", "hashmap", "regexp"}
+
+// Reports whether method is the name of a search method.
+func IsMethod(method string) bool {
+	for _, m := range Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
 }
 
 // A wrapper for the Locate.+ functions.
@@ -205,23 +317,41 @@ func (db *DB) LocateSubstring(name string, ch chan string) (err error) {
 //  "wildcard", "substring", "levenshtein", "hashmap", "regexp"
 // Returns the matches through a given channel.
 func Locate(db *DB, method, pattern string, ch chan string) (err error) {
+	return LocateWith(db, method, pattern, ch, &db.options)
+}
+
+// LocateWith is like Locate, but searches using the given options instead of
+// the ones the DB was created with. Root and HashMap have no effect, nor do
+// IgnoreCase and StripExtension for the hashmap method.
+func LocateWith(db *DB, method, pattern string, ch chan string, options *Options) (err error) {
+	return LocateContext(context.Background(), db, method, pattern, ch, options, nil)
+}
+
+// LocateContext is like LocateWith, but gives up when ctx is done, returning
+// ctx.Err(). Unless nil, progress is updated while searching.
+func LocateContext(ctx context.Context, db *DB, method, pattern string, ch chan string, options *Options, progress *Progress) (err error) {
 	defer close(ch)
 
 	switch method {
 	case "wildcard":
-		return db.LocateWildcard(pattern, ch)
+		return db.locateWildcard(ctx, pattern, ch, options, progress)
 	case "substring":
-		return db.LocateSubstring(pattern, ch)
+		return db.locateSubstring(ctx, pattern, ch, options, progress)
 	case "levenshtein":
-		return db.LocateLevenshtein(pattern, ch)
+		return db.locateLevenshtein(ctx, pattern, ch, options, progress)
 	case "hashmap":
-		return db.LocateHashMap(pattern, ch)
+		return db.locateHashMap(ctx, pattern, ch, options, progress)
 	case "regexp":
-		return db.LocateRegexp(pattern, ch)
+		return db.locateRegexp(ctx, pattern, ch, options, progress)
 	}
 	return errors.New("No such search method as " + method)
 }
 
+// Options returns the options the DB was created with.
+func (db *DB) Options() Options {
+	return db.options
+}
+
 // A wrapper for the Locate.+ functions.
 // Stores results of a Locate call in a string array, returns afterwards.
 func locateIntoArray(pattern string, locateFn func(pattern string, ch chan string) error) (matches []string, err error) {
@@ -12,6 +12,7 @@ type Options struct {
 	Basename             bool                  // Basename _must_ match
 	StripPath            bool                  // Match only basenames, ignoring directory parts.
 	Existing             bool                  // List only existing files.
+	Follow               bool                  // Follow symlinks when checking for existence; dangling or looping symlinks are dropped.
 	Accessable           bool                  // List only (read-) accessable files
 	Symlink              bool                  // List symlinks as well.
 	HashMap              bool                  // Enable this if you want a lookup table generated by NewDB.
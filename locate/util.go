@@ -2,6 +2,7 @@ package locate
 
 import (
 	"bytes"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -66,8 +67,18 @@ func existing(path string) (exists, issym bool, err error) {
 	return
 }
 
+// Reports whether err, as returned by os.Stat, means that the chain of
+// symlinks does not lead to an existing file, or loops.
+func dangling(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOENT || err == syscall.ENOTDIR || err == syscall.ELOOP
+}
+
 // Checks whether the file can be considered a match according to given options
 // Existing option requires the file to exist
+// Follow option makes Existing require the symlink chain to end in an existing file
 // Symlink option allows the file to be a symlink
 func fileOkay(path string, options *Options) (bool, error) {
 	var fi syscall.Stat_t
@@ -81,6 +92,16 @@ func fileOkay(path string, options *Options) (bool, error) {
 		return false, nil
 	} // Drop dead files...
 
+	issym := fi.Mode&syscall.S_IFMT == syscall.S_IFLNK
+	if options.Existing && options.Follow && issym {
+		if _, err := os.Stat(path); err != nil {
+			if dangling(err) {
+				return false, nil
+			}
+			return false, err
+		}
+	} // ...dangling symlinks...
+
 	if options.Accessable { // FIXME(utkan): No R_OK(=4) in syscall package!
 		err = syscall.Access(path, 4)
 		if err != nil {
@@ -88,7 +109,6 @@ func fileOkay(path string, options *Options) (bool, error) {
 		}
 	}
 
-	issym := fi.Mode&syscall.S_IFLNK == syscall.S_IFLNK
 	if options.Symlink == false && issym {
 		return false, nil
 	} // ...and symlinks, if necessary.
@@ -30,7 +30,6 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"os"
 	"path/filepath"
 	. "symutils/common"
@@ -52,6 +51,8 @@ var (
 	nmatchMin            = flag.Int("N", 0, "Minimum number of identical symlinks (in different dirs) to be enlisted. (0 means # of given directories.)")
 	includeOrdinaryFiles = flag.Bool("o", false, "Do not discard ordinary files")
 	checkSymlink         = flag.Bool("c", false, "Check symlinks before enlisting")
+	nullSep              = flag.Bool("0", false, "Separate entries with NUL instead of newline on output")
+	outputFormat         = flag.String("format", "plain", OutputFormatUsage)
 
 	verbose = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
 )
@@ -62,6 +63,7 @@ var (
 	nametabs   []nametab_t
 	curNametab nametab_t
 	currentDir string
+	out        *Output
 )
 
 func WalkFunc(path string, info os.FileInfo, err error) error {
@@ -138,6 +140,11 @@ func init() {
 		PrintHelp(pkg, version, about, usage)
 		return
 	}
+
+	var err error
+	if out, err = NewOutput(os.Stdout, *outputFormat, *nullSep); err != nil {
+		Errorln(err)
+	}
 }
 
 func main() {
@@ -163,7 +170,7 @@ func main() {
 	}
 	for f, n := range utab {
 		if n >= *nmatchMin {
-			fmt.Println(f)
+			out.Write(Record{Path: f})
 		}
 	}
 }
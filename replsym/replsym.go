@@ -49,6 +49,10 @@ var (
 	rename          = flag.Bool("R", false, "Rename symlinks as target's basename")
 	showVersion     = flag.Bool("V", false, "Show version and license info and quit")
 	showHelp        = flag.Bool("h", false, "Display help and quit")
+	nullSep         = flag.Bool("0", false, "Separate listed symlinks with NUL instead of newline")
+	outputFormat    = flag.String("format", "plain", OutputFormatUsage+" In replacement mode, json and csv report the replaced symlinks.")
+	linkStyle       = flag.String("style", "preserve", LinkStyleUsage+" A relative -t is relative to the directory of each symlink.")
+	journalPath     = flag.String("journal", DefaultJournalPath(), JournalUsage)
 
 	verbose = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
 )
@@ -63,7 +67,11 @@ const (
 		"replsym -p target_pattern [-t new_target] [-m match_type -i -v -r] symlink1/dir1 ... symlinkN/dirN"
 )
 
-var match func(pattern, filename string) bool
+var (
+	match   func(pattern, filename string) bool
+	out     *Output
+	journal *Journal
+)
 
 func imatch(pattern, filename string) bool {
 	if *caseInsensitive {
@@ -97,40 +105,52 @@ func WalkFunc(path string, info os.FileInfo, err error) error {
 		log.Fatal(err)
 	}
 
+	dir, _ := filepath.Split(path)
 	if imatch(*pattern, oldtarget) {
 		Logf("%s -> %s matches the pattern %s\n", path, oldtarget, *pattern)
 
 		if *target == "" {
-			fmt.Println(MakeAbsolute(path, ""))
+			out.Write(Record{Path: MakeAbsolute(path, ""), Target: oldtarget})
 			return nil
 		}
 
 		newname := path
 		if *rename {
-			newname = filepath.Base(*target)
-			dir, _ := filepath.Split(path)
-			newname = filepath.Join(dir, newname)
+			newname = filepath.Join(dir, filepath.Base(*target))
+		}
+		newtarget, err := LinkTarget(*linkStyle, newname, oldtarget, *target)
+		if err != nil {
+			return err
 		}
 
-		Logf("%s -> %s is being replaced by  %s -> %s\n", path, oldtarget, newname, *target)
+		Logf("%s -> %s is being replaced by  %s -> %s\n", path, oldtarget, newname, newtarget)
 
-		replace(newname, path, *target)
+		if err := replace(newname, path, oldtarget, newtarget); err != nil {
+			return err
+		}
+		if out.Structured() {
+			out.Write(Record{Path: MakeAbsolute(newname, ""), Target: newtarget, Action: "replace"})
+		}
 	}
 
 	return nil
 }
 
-func replace(newname, oldname, target string) {
-	err := os.Remove(oldname)
+// Replaces the symlink oldname -> oldtarget with newname -> target, see
+// ReplaceSymlink. The old link is left alone on errors.
+// The change is journaled first: it isn't made if it can't be undone.
+func replace(newname, oldname, oldtarget, target string) error {
+	e, err := journal.Begin(oldname, oldtarget, newname, target)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("journal: %v", err)
 	}
-
-	err = os.Symlink(target, newname)
-	if err != nil {
-		log.Fatal(err)
+	if err := ReplaceSymlink(oldname, newname, target); err != nil {
+		return err
+	}
+	if err := journal.Done(e); err != nil {
+		return fmt.Errorf("journal: %v", err)
 	}
-	return
+	return nil
 }
 
 func init() {
@@ -153,6 +173,19 @@ func init() {
 		os.Exit(0)
 	}
 
+	var err error
+	if out, err = NewOutput(os.Stdout, *outputFormat, *nullSep); err != nil {
+		Errorln(err)
+	}
+	if err = CheckLinkStyle(*linkStyle); err != nil {
+		Errorln(err)
+	}
+	if *target != "" {
+		if journal, err = OpenJournal(*journalPath, pkg); err != nil {
+			Errorln("journal:", err)
+		}
+	}
+
 	switch *matchMethod {
 	case "exact":
 		match = func(pattern, filename string) bool {
@@ -187,4 +220,5 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	journal.Close()
 }
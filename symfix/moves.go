@@ -0,0 +1,166 @@
+package main
+
+/*
+ * Detection of directory moves: when many dead targets under a directory that
+ * is gone have candidates at the same relative paths under another directory,
+ * the directory has most likely been moved (or renamed) there, and the links
+ * can be fixed as a group.
+ * */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	. "symutils/common"
+)
+
+type brokenLink struct {
+	path, dst string
+}
+
+// A directory move, and the broken links it explains.
+type move struct {
+	from, to string
+	links    []brokenLink
+}
+
+var (
+	handled   = make(map[string]bool) // Symlinks already taken care of by a move
+	confirmed bool                    // Set while relinking a group the user agreed to
+)
+
+// Returns the topmost directory above path that is gone, or "" if the parent
+// of path exists.
+func goneDir(path string) string {
+	gone := ""
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		gone = dir
+	}
+	return gone
+}
+
+// Lists the broken symlinks under the given files/dirs, as symfixr would
+// visit them.
+func brokenUnder(roots []string) []brokenLink {
+	var links []brokenLink
+	for _, r := range roots {
+		filepath.Walk(r, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && !*recurse {
+				return filepath.SkipDir
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			if ok, dst, err := LinkAlive(path, false); err == nil && !ok {
+				links = append(links, brokenLink{path, MakeAbsolute(strings.TrimSuffix(dst, "/"), "")})
+			}
+			return nil
+		})
+	}
+	return links
+}
+
+// Finds the directory moves that explain at least -moves broken links, the
+// most convincing first.
+func findMoves(links []brokenLink) []*move {
+	byDirs := make(map[[2]string]*move)
+	for _, l := range links {
+		gone := goneDir(l.dst)
+		if gone == "" {
+			continue
+		}
+		rel := l.dst[len(gone):]
+
+		matches, err := mylocate(db, filepath.Base(l.dst))
+		if err != nil {
+			Warnf("%v\n", err)
+			continue
+		}
+		for _, m := range matches {
+			if !strings.HasSuffix(m, rel) {
+				continue
+			}
+			to := m[:len(m)-len(rel)]
+			if fi, err := os.Stat(to); err != nil || !fi.IsDir() {
+				continue
+			}
+
+			key := [2]string{gone, to}
+			mv, ok := byDirs[key]
+			if !ok {
+				mv = &move{from: gone, to: to}
+				byDirs[key] = mv
+			}
+			if n := len(mv.links); n == 0 || mv.links[n-1] != l {
+				mv.links = append(mv.links, l)
+			}
+		}
+	}
+
+	var moves []*move
+	for _, mv := range byDirs {
+		if len(mv.links) >= int(*moveMin) {
+			moves = append(moves, mv)
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		if len(moves[i].links) != len(moves[j].links) {
+			return len(moves[i].links) > len(moves[j].links)
+		}
+		if moves[i].from != moves[j].from {
+			return moves[i].from < moves[j].from
+		}
+		return moves[i].to < moves[j].to
+	})
+	return moves
+}
+
+// Proposes the moves, and relinks the links of those accepted, rewriting the
+// prefix of their targets. Links left out are fixed one by one later on.
+// In automated mode, a move is taken only if it's the only one found for its
+// directory.
+func applyMoves(moves []*move) {
+	rivals := make(map[string]int)
+	for _, mv := range moves {
+		rivals[mv.from]++
+	}
+
+	for _, mv := range moves {
+		if rivals[mv.from] < 0 { // Already moved
+			continue
+		}
+
+		reason := fmt.Sprintf("%s seems to have moved to %s, judging by %d dead links", mv.from, mv.to, len(mv.links))
+		if *automatedMode && rivals[mv.from] > 1 {
+			Logf("Automated mode, %d possible moves for %s\n", rivals[mv.from], mv.from)
+			if *dryRun {
+				plan("skip", "move "+mv.from+" => "+mv.to, fmt.Sprintf("%d possible moves for %s, automated mode", rivals[mv.from], mv.from))
+			}
+			continue
+		}
+		if *dryRun {
+			plan("move", mv.from+" => "+mv.to, reason)
+		} else if !okay("%d dead links point under %s, which seems to have moved to %s. Relink them all?", len(mv.links), mv.from, mv.to) {
+			continue
+		}
+		rivals[mv.from] = -1
+
+		confirmed = true
+		for _, l := range mv.links {
+			if handled[l.path] {
+				continue
+			}
+			handled[l.path] = true
+			tally(l.path, relink(l.path, mv.to+l.dst[len(mv.from):], reason))
+		}
+		confirmed = false
+	}
+}
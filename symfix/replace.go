@@ -4,19 +4,23 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 type Rule struct {
-	method string
-	s      string // Source target filename, or the pattern to match the source target filename
-	d      string // New target for the symlink
-	re     *regexp.Regexp
+	method     string
+	s          string // Source target filename, or the pattern to match the source target filename
+	d          string // New target for the symlink
+	re         *regexp.Regexp
+	ignoreCase bool
+	expand     bool // Substitute the capture groups of regexp rules in d
+	priority   int  // Rules with a higher priority are tried first
+	stop       bool // Try no other rule once this one matches
+	line       int  // Line of the rule in the rules file
 }
 
 func trim(str string) string {
@@ -27,6 +31,9 @@ func trim(str string) string {
 //     [rule] `[src]` `[dst]`
 // Where rule is a single character determining the match method: h(ashmap), s(ubstring), w(ildcard), r(egexp).
 // If [rule] is skipped an the line starts which a ` character directly, then it's assumed to be h(ashmap).
+// In the dst of a regexp rule, $1 (or ${1}, ${name}) is replaced with the text matched by the
+// corresponding capture group in src, see regexp.Expand. A literal $ is written as $$; a $ that
+// names no capture group is an error.
 func NewRule(line string) (*Rule, error) {
 	r := new(Rule)
 
@@ -83,34 +90,198 @@ func NewRule(line string) (*Rule, error) {
 		return nil, errors.New("src and dst should not be empty strings")
 	}
 
-	if r.method == "regexp" {
-		r.re = regexp.MustCompile(r.s)
+	r.expand = r.method == "regexp"
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	if err := r.checkTarget(); err != nil {
+		return nil, err
 	}
-
 	return r, nil
 }
 
+// Checks the pattern of the rule, and compiles it if it's a regexp.
+func (r *Rule) compile() error {
+	switch r.method {
+	case "regexp":
+		expr := r.s
+		if r.ignoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	case "wildcard":
+		if _, err := filepath.Match(r.s, ""); err != nil {
+			return fmt.Errorf("%v: %s", err, r.s)
+		}
+		re, err := wildcardRegexp(r.s, r.ignoreCase)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, r.s)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// Checks that every $ in the target of a rule that expands them names a
+// capture group, or is written $$, so that none silently expands to nothing.
+// The rule must be compiled.
+func (r *Rule) checkTarget() error {
+	if r.method != "regexp" || !r.expand {
+		return nil
+	}
+	template := r.d
+	for i := 0; i < len(template); i++ {
+		if template[i] != '$' {
+			continue
+		}
+		i++
+		if i < len(template) && template[i] == '$' {
+			continue
+		}
+
+		var name string
+		if i < len(template) && template[i] == '{' {
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return fmt.Errorf("unterminated ${ in %s", template)
+			}
+			name = template[i+1 : i+end]
+			i += end
+		} else {
+			start := i
+			for i < len(template) && (template[i] == '_' || isAlnum(template[i])) {
+				i++
+			}
+			name = template[start:i]
+			i--
+		}
+
+		if n, err := strconv.Atoi(name); err == nil && n <= r.re.NumSubexp() {
+			continue
+		}
+		if name != "" && r.re.SubexpIndex(name) >= 0 {
+			continue
+		}
+		return fmt.Errorf("$%s in %s is no capture group of %s, write $$ for a literal $ (or ${1}x for group 1 followed by x)", name, template, r.s)
+	}
+	return nil
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// Translates a pattern in the syntax of filepath.Match to a regexp matching
+// the same names, so that ignoreCase applies to character classes as well.
+func wildcardRegexp(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	notSep := "[^" + regexp.QuoteMeta(string(filepath.Separator)) + "]"
+	literal := func(c rune) string { return fmt.Sprintf(`\x{%x}`, c) }
+
+	var b strings.Builder
+	if ignoreCase {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	chars := []rune(pattern)
+	for i := 0; i < len(chars); i++ {
+		switch c := chars[i]; c {
+		case '*':
+			b.WriteString(notSep + "*")
+		case '?':
+			b.WriteString(notSep)
+		case '\\':
+			if i++; i == len(chars) {
+				return nil, filepath.ErrBadPattern
+			}
+			b.WriteString(literal(chars[i]))
+		case '[':
+			b.WriteString("[")
+			if i+1 < len(chars) && chars[i+1] == '^' {
+				b.WriteString("^")
+				i++
+			}
+			for i++; i < len(chars) && chars[i] != ']'; i++ {
+				switch chars[i] {
+				case '-':
+					b.WriteString("-")
+				case '\\':
+					if i++; i == len(chars) {
+						return nil, filepath.ErrBadPattern
+					}
+					fallthrough
+				default:
+					b.WriteString(literal(chars[i]))
+				}
+			}
+			if i == len(chars) {
+				return nil, filepath.ErrBadPattern
+			}
+			b.WriteString("]")
+		default:
+			b.WriteString(literal(c))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
 func (r *Rule) String() string {
-	return r.method + ": " + r.s + " -> " + r.d
+	var opts []string
+	if r.ignoreCase {
+		opts = append(opts, "ignorecase")
+	}
+	if r.method == "regexp" && !r.expand {
+		opts = append(opts, "no expand")
+	}
+	if r.priority != 0 {
+		opts = append(opts, fmt.Sprintf("priority %d", r.priority))
+	}
+	if r.stop {
+		opts = append(opts, "stop")
+	}
+
+	s := r.method + ": " + r.s + " -> " + r.d
+	if len(opts) > 0 {
+		s += " (" + strings.Join(opts, ", ") + ")"
+	}
+	return s
 }
 
-func (r *Rule) Match(pattern string) bool {
+// Match reports whether the rule applies to the dead target filename.
+func (r *Rule) Match(filename string) bool {
 	switch r.method {
 	case "hashmap":
-		return pattern == r.s
+		if r.ignoreCase {
+			return strings.EqualFold(filename, r.s)
+		}
+		return filename == r.s
 	case "substring":
-		return strings.Contains(pattern, r.s)
-	case "wildcard":
-		m, _ := filepath.Match(pattern, r.s)
-		return m
-	case "regexp":
-		return r.re.MatchString(r.s)
+		if r.ignoreCase {
+			return strings.Contains(strings.ToLower(filename), strings.ToLower(r.s))
+		}
+		return strings.Contains(filename, r.s)
+	case "wildcard", "regexp":
+		return r.re.MatchString(filename)
 	}
 	panic("shouldn't happen")
 }
 
+// Target returns the new target for the dead target filename, which the rule
+// must match. Capture groups are substituted for regexp rules, unless expand
+// is turned off.
+func (r *Rule) Target(filename string) string {
+	if r.method != "regexp" || !r.expand {
+		return r.d
+	}
+	return string(r.re.ExpandString(nil, r.d, filename, r.re.FindStringSubmatchIndex(filename)))
+}
+
 type Replacer struct {
-	rules []*Rule
+	rules []*Rule // In the order they are tried
 }
 
 func (replacer *Replacer) Add(line string) error {
@@ -123,47 +294,61 @@ func (replacer *Replacer) Add(line string) error {
 	return nil
 }
 
-func NewReplacer(rulefile string) (replacer *Replacer, err error) {
-	f, err := os.Open(rulefile)
-	if err != nil {
-		return
+// Errors found in a rules file, one per line.
+type ruleErrors []error
+
+func (errs ruleErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
 	}
+	return strings.Join(msgs, "\n")
+}
 
-	file, err := ioutil.ReadAll(f)
+// Reads the rules in rulefile, either in the structured format (see rules.go)
+// or one rule per line (see NewRule). Reports all the errors in the file.
+func NewReplacer(rulefile string) (*Replacer, error) {
+	file, err := ioutil.ReadFile(rulefile)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	replacer = new(Replacer)
+	rules, errs := parseRules(rulefile, file)
+	if len(errs) > 0 {
+		return nil, ruleErrors(errs)
+	}
+	return &Replacer{rules}, nil
+}
 
-	buf := bytes.NewBuffer(file)
-	for nline := 1; ; nline++ {
-		line, err := buf.ReadString('\n') // BUG(utkan): Will not work in Windows.
+// Parses the one-rule-per-line format.
+func parseLines(name string, lines []string) (rules []*Rule, errs []error) {
+	for i, line := range lines {
 		line = trim(line)
-
-		if len(line) != 0 && line[0] != '#' {
-			if err = replacer.Add(line); err != nil {
-				return nil, fmt.Errorf("NewReplacer: invalid input in rule file %s:%d: %s\n", rulefile, nline, err)
-			}
-		}
-
-		if err == io.EOF {
-			break
+		if len(line) == 0 || line[0] == '#' {
+			continue
 		}
-
+		rule, err := NewRule(line)
 		if err != nil {
-			return nil, err
+			errs = append(errs, &lineError{name, i + 1, err.Error()})
+			continue
 		}
+		rule.line = i + 1
+		rules = append(rules, rule)
 	}
-
 	return
 }
 
+// Returns the new targets the rules give for the dead target filename.
+// Rules are tried by decreasing priority, and in the order they appear in the
+// file for the same priority; a matching rule with stop set ends the search.
 func (r *Replacer) Replace(filename string) (matches []string) {
 	matches = make([]string, 0)
 	for _, rule := range r.rules {
 		if rule.Match(filename) {
-			matches = append(matches, rule.d)
+			matches = append(matches, rule.Target(filename))
+			if rule.stop {
+				break
+			}
 		}
 	}
 	return
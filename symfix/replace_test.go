@@ -0,0 +1,113 @@
+package main
+
+import "testing"
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		method, match string
+		ignoreCase    bool
+		filename      string
+		want          bool
+	}{
+		{"hashmap", "/a/f", false, "/a/f", true},
+		{"hashmap", "/a/f", false, "/a/F", false},
+		{"hashmap", "/a/f", true, "/A/F", true},
+		{"substring", "old", false, "/mnt/old/f", true},
+		{"substring", "old", false, "/mnt/OLD/f", false},
+		{"substring", "old", true, "/mnt/OLD/f", true},
+		{"wildcard", "/mnt/*/f", false, "/mnt/old/f", true},
+		{"wildcard", "/mnt/*/f", false, "/mnt/a/b/f", false}, // * stops at separators
+		{"wildcard", "/mnt/?/f", false, "/mnt/a/f", true},
+		{"wildcard", "/mnt/*.MP3", true, "/mnt/song.mp3", true},
+		{"wildcard", "/mnt/[A-C]*", true, "/mnt/beta", true},
+		{"wildcard", "/mnt/[A-C]*", false, "/mnt/beta", false},
+		{"wildcard", "/mnt/[^a-c]*", true, "/mnt/Beta", false},
+		{"wildcard", "/mnt/[^a-c]*", false, "/mnt/delta", true},
+		{"wildcard", `/mnt/\*`, false, "/mnt/*", true},
+		{"wildcard", `/mnt/\*`, false, "/mnt/x", false},
+		{"wildcard", "/mnt/a.b", false, "/mnt/axb", false},
+		{"regexp", "^/mnt/old/", false, "/mnt/old/f", true},
+		{"regexp", "^/mnt/old/", false, "/mnt/OLD/f", false},
+		{"regexp", "^/mnt/old/", true, "/mnt/OLD/f", true},
+	}
+	for _, tt := range tests {
+		r := &Rule{method: tt.method, s: tt.match, d: "/new", ignoreCase: tt.ignoreCase}
+		if err := r.compile(); err != nil {
+			t.Errorf("%v: %v", r, err)
+			continue
+		}
+		if got := r.Match(tt.filename); got != tt.want {
+			t.Errorf("%v: Match(%q) = %v, want %v", r, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestRuleTarget(t *testing.T) {
+	tests := []struct {
+		method, match, target string
+		expand                bool
+		filename, want        string
+	}{
+		{"regexp", "^/mnt/old/(.*)$", "/mnt/new/$1", true, "/mnt/old/a/f", "/mnt/new/a/f"},
+		{"regexp", "^/mnt/(?P<dir>[^/]*)/f$", "/srv/${dir}/f", true, "/mnt/old/f", "/srv/old/f"},
+		{"regexp", "^/mnt/old/(.*)$", "/price$$", true, "/mnt/old/f", "/price$"},
+		{"regexp", "^/mnt/old/(.*)$", "/mnt/new/$1", false, "/mnt/old/f", "/mnt/new/$1"},
+		{"wildcard", "/mnt/*", "/mnt/$1", true, "/mnt/f", "/mnt/$1"},
+		{"hashmap", "/a/f", "/b/f", false, "/a/f", "/b/f"},
+	}
+	for _, tt := range tests {
+		r := &Rule{method: tt.method, s: tt.match, d: tt.target, expand: tt.expand}
+		if err := r.compile(); err != nil {
+			t.Errorf("%v: %v", r, err)
+			continue
+		}
+		if got := r.Target(tt.filename); got != tt.want {
+			t.Errorf("%v: Target(%q) = %q, want %q", r, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		line, method, match, target string
+		newTarget                   string // Target for /a/f
+		err                         bool
+	}{
+		{"`/a/f` `/b/f`", "hashmap", "/a/f", "/b/f", "/b/f", false},
+		{"s`old` `/new/$1`", "substring", "old", "/new/$1", "/new/$1", false},
+		{"w`/a/*` `/b/$1`", "wildcard", "/a/*", "/b/$1", "/b/$1", false},
+		{"r`^/a/(.*)$` `/b/$1`", "regexp", "^/a/(.*)$", "/b/$1", "/b/f", false},
+		{"r`^/a/(.*)$` `/b/${1}x`", "regexp", "^/a/(.*)$", "/b/${1}x", "/b/fx", false},
+		{"r`^/a/(?P<name>.*)$` `/b/$name`", "regexp", "^/a/(?P<name>.*)$", "/b/$name", "/b/f", false},
+		{"r`^/a/(.*)$` `/b/$$1`", "regexp", "^/a/(.*)$", "/b/$$1", "/b/$1", false},
+		{"r`^/a/(.*)$` `/b/$0`", "regexp", "^/a/(.*)$", "/b/$0", "/b//a/f", false},
+		{"r`^/a/(.*)$` `/b/$2`", "", "", "", "", true},
+		{"r`^/a/(.*)$` `/b/$1x`", "", "", "", "", true},
+		{"r`^/a/(.*)$` `/b/$`", "", "", "", "", true},
+		{"r`^/a/(.*)$` `/b/${1`", "", "", "", "", true},
+		{"x`a` `b`", "", "", "", "", true},
+		{"`a` `b", "", "", "", "", true},
+		{"`` `b`", "", "", "", "", true},
+		{"r`(` `b`", "", "", "", "", true},
+		{"w`[a` `b`", "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		r, err := NewRule(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("NewRule(%q) = %v, want an error", tt.line, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewRule(%q): %v", tt.line, err)
+			continue
+		}
+		if r.method != tt.method || r.s != tt.match || r.d != tt.target {
+			t.Errorf("NewRule(%q) = %v, want %s: %s -> %s", tt.line, r, tt.method, tt.match, tt.target)
+		}
+		if got := r.Target("/a/f"); got != tt.newTarget {
+			t.Errorf("NewRule(%q): Target = %q, want %q", tt.line, got, tt.newTarget)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+/*
+ * Structured format of the replacement rules file, a subset of TOML:
+
+	# Comments start with #
+	[[rule]]
+	method = "regexp"       # hashmap (default), substring, wildcard or regexp
+	match = '^/old/(.*)$'   # Pattern the dead target is matched against
+	target = "/new/$1"      # New target
+	ignorecase = true       # Case insensitive matching, false by default
+	priority = 10           # Rules with a higher priority are tried first, 0 by default
+	stop = true             # Try no other rule once this one matches, false by default
+	expand = false          # Substitute $1 etc. in target (regexp rules only), true by default
+
+ * Strings are either "basic", where \", \\, \t, \n, \r and \uXXXX are escapes,
+ * or 'literal', taken as is.
+ * A file whose first line (other than blanks and comments) starts with [ is in
+ * this format, otherwise it's in the one rule per line format, see NewRule.
+ * */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ruleMethods = map[string]bool{"hashmap": true, "substring": true, "wildcard": true, "regexp": true}
+
+// An error on a line of a rules file.
+type lineError struct {
+	name string
+	line int
+	msg  string
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.name, e.line, e.msg)
+}
+
+// Parses a rules file in either format, and sorts the rules by priority.
+func parseRules(name string, file []byte) (rules []*Rule, errs []error) {
+	lines := strings.Split(string(file), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	structured := false
+	for _, line := range lines {
+		line = trim(line)
+		if line != "" && line[0] != '#' {
+			structured = line[0] == '['
+			break
+		}
+	}
+
+	if structured {
+		rules, errs = parseStructured(name, lines)
+	} else {
+		rules, errs = parseLines(name, lines)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].priority > rules[j].priority })
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].(*lineError).line < errs[j].(*lineError).line })
+	return
+}
+
+// Parses the structured format.
+func parseStructured(name string, lines []string) (rules []*Rule, errs []error) {
+	var r *Rule
+	var seen map[string]int // Lines of the keys given for r
+
+	fail := func(nline int, format string, va ...interface{}) {
+		errs = append(errs, &lineError{name, nline, fmt.Sprintf(format, va...)})
+	}
+
+	// Checks the rule that just ended, and adds it.
+	end := func() {
+		if r == nil {
+			return
+		}
+		ok := true
+		for _, key := range []string{"match", "target"} {
+			if seen[key] == 0 {
+				fail(r.line, "rule has no %s", key)
+				ok = false
+			}
+		}
+		if seen["expand"] != 0 && r.method != "regexp" {
+			fail(seen["expand"], "expand applies to regexp rules only")
+			ok = false
+		}
+		if ok {
+			if err := r.compile(); err != nil {
+				fail(seen["match"], "match: %v", err)
+			} else if err := r.checkTarget(); err != nil {
+				fail(seen["target"], "target: %v", err)
+			} else {
+				rules = append(rules, r)
+			}
+		}
+		r = nil
+	}
+
+	for i, line := range lines {
+		nline := i + 1
+		line = trim(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			header := trim(stripComment(line))
+			if header != "[[rule]]" {
+				fail(nline, "unknown table %s, only [[rule]] is supported", header)
+				continue
+			}
+			end()
+			r = &Rule{method: "hashmap", expand: true, line: nline}
+			seen = make(map[string]int)
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			fail(nline, "expected key = value")
+			continue
+		}
+		key := trim(line[:eq])
+		value, err := parseValue(trim(line[eq+1:]))
+		if err != nil {
+			fail(nline, "%s: %v", key, err)
+			continue
+		}
+		if r == nil {
+			fail(nline, "%s outside of a [[rule]]", key)
+			continue
+		}
+		if seen[key] != 0 {
+			fail(nline, "%s given twice, first on line %d", key, seen[key])
+			continue
+		}
+		seen[key] = nline
+
+		if err := r.set(key, value); err != nil {
+			fail(nline, "%s: %v", key, err)
+		}
+	}
+	end()
+	return
+}
+
+// Sets an option of the rule.
+func (r *Rule) set(key string, value interface{}) error {
+	var ok bool
+	switch key {
+	case "method":
+		if r.method, ok = value.(string); ok && !ruleMethods[r.method] {
+			return errors.New("unknown method " + r.method + ", should be hashmap, substring, wildcard or regexp")
+		}
+	case "match":
+		if r.s, ok = value.(string); ok && r.s == "" {
+			return errors.New("should not be empty")
+		}
+	case "target":
+		if r.d, ok = value.(string); ok && r.d == "" {
+			return errors.New("should not be empty")
+		}
+	case "ignorecase":
+		r.ignoreCase, ok = value.(bool)
+	case "stop":
+		r.stop, ok = value.(bool)
+	case "expand":
+		r.expand, ok = value.(bool)
+	case "priority":
+		r.priority, ok = value.(int)
+	default:
+		return errors.New("unknown key")
+	}
+
+	if !ok {
+		return fmt.Errorf("unexpected value %v", value)
+	}
+	return nil
+}
+
+// Strips a trailing comment from something that contains no strings.
+func stripComment(s string) string {
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Parses a value: a string, a boolean or an integer, optionally followed by
+// a comment.
+func parseValue(s string) (interface{}, error) {
+	if s == "" {
+		return nil, errors.New("missing value")
+	}
+
+	var value interface{}
+	var rest string
+	switch s[0] {
+	case '"':
+		var b strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i++; i == len(s) {
+				break
+			}
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u':
+				if i+5 > len(s) {
+					return nil, errors.New(`incomplete \u escape`)
+				}
+				c, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil {
+					return nil, errors.New(`invalid \u escape`)
+				}
+				b.WriteRune(rune(c))
+				i += 4
+			default:
+				return nil, fmt.Errorf(`invalid escape \%c`, s[i])
+			}
+		}
+		if i >= len(s) {
+			return nil, errors.New("unterminated string")
+		}
+		value, rest = b.String(), s[i+1:]
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, errors.New("unterminated string")
+		}
+		value, rest = s[1:end+1], s[end+2:]
+	default:
+		word := trim(stripComment(s))
+		rest = s[len(word):]
+		switch word {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		default:
+			n, err := strconv.Atoi(word)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s, strings should be quoted", word)
+			}
+			value = n
+		}
+	}
+
+	if rest = trim(rest); rest != "" && rest[0] != '#' {
+		return nil, fmt.Errorf("unexpected %s after the value", rest)
+	}
+	return value, nil
+}
+
+// Handles `symfix check-rules file...`: reports every error in the rules
+// files, and quits with status 1 if there are any.
+func checkRules(files []string) {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: symfix check-rules rulefile1 [rulefile2 ...]")
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, name := range files {
+		file, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+
+		rules, errs := parseRules(name, file)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %d rules, in the order they are tried:\n", name, len(rules))
+		for _, r := range rules {
+			fmt.Printf("%s:%d: %v\n", name, r.line, r)
+		}
+	}
+	os.Exit(status)
+}
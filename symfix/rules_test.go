@@ -0,0 +1,208 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+		err  string // Part of the error, if one is expected
+	}{
+		{`"abc"`, "abc", ""},
+		{`"a\"b\\c"`, `a"b\c`, ""},
+		{`"a\tb\nc\r"`, "a\tb\nc\r", ""},
+		{`"caf\u00e9"`, "café", ""},
+		{`"\u20ac5"`, "€5", ""},
+		{`"\u12"`, nil, `incomplete \u escape`},
+		{`"\uzzzz"`, nil, `invalid \u escape`},
+		{`"\x"`, nil, `invalid escape \x`},
+		{`"abc`, nil, "unterminated string"},
+		{`"abc\"`, nil, "unterminated string"},
+		{`'abc`, nil, "unterminated string"},
+		{`"abc" # comment`, "abc", ""},
+		{`"a#b" # comment`, "a#b", ""},
+		{`'a#b'`, "a#b", ""},
+		{`'a#b' # comment`, "a#b", ""},
+		{`'C:\dir\$1'`, `C:\dir\$1`, ""},
+		{`"abc" def`, nil, "unexpected def"},
+		{`true`, true, ""},
+		{`false # comment`, false, ""},
+		{`-3`, -3, ""},
+		{`10#comment`, 10, ""},
+		{`abc`, nil, "strings should be quoted"},
+		{``, nil, "missing value"},
+	}
+	for _, tt := range tests {
+		got, err := parseValue(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseValue(%s) = %v, %v, want error %q", tt.in, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseValue(%s) = %#v, %v, want %#v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		rules []string // The rules, as Rule.String, in the order they are tried
+		lines []int    // Lines of the rules
+		errs  []string
+	}{
+		{
+			name: "line format",
+			file: "# comment\n`/a/f` `/b/f`\n\nr`^/c/(.*)$` `/d/$1`\n",
+			rules: []string{
+				"hashmap: /a/f -> /b/f",
+				"regexp: ^/c/(.*)$ -> /d/$1",
+			},
+			lines: []int{2, 4},
+		},
+		{
+			name:  "structured",
+			file:  "# comment\n\n[[rule]]\nmatch = \"/a/f\"\ntarget = \"/b/f\"\n",
+			rules: []string{"hashmap: /a/f -> /b/f"},
+			lines: []int{3},
+		},
+		{
+			name:  "CRLF",
+			file:  "[[rule]]\r\nmatch = '/a/f'\r\ntarget = '/b/f'\r\n",
+			rules: []string{"hashmap: /a/f -> /b/f"},
+			lines: []int{1},
+		},
+		{
+			name: "priority",
+			file: `[[rule]]
+match = "a"
+target = "/1"
+
+[[rule]]
+match = "b"
+target = "/2"
+priority = 10
+
+[[rule]]
+match = "c"
+target = "/3"
+priority = -1
+
+[[rule]]
+match = "d"
+target = "/4"
+priority = 10
+stop = true
+`,
+			rules: []string{
+				"hashmap: b -> /2 (priority 10)",
+				"hashmap: d -> /4 (priority 10, stop)",
+				"hashmap: a -> /1",
+				"hashmap: c -> /3 (priority -1)",
+			},
+			lines: []int{5, 15, 1, 10},
+		},
+		{
+			name: "options",
+			file: `[[rule]]
+method = "wildcard"  # comment
+match = '/a/*'
+target = "/b/f"
+ignorecase = true
+`,
+			rules: []string{"wildcard: /a/* -> /b/f (ignorecase)"},
+			lines: []int{1},
+		},
+		{
+			name: "structured errors",
+			file: `[table]
+method = "regexp"
+[[rule]]
+match = "a"
+match = "b"
+bogus = 1
+[[rule]]
+method = "substring"
+match = "c"
+target = "/d"
+expand = false
+[[rule]]
+method = "regexp"
+match = "("
+target = "/e"
+[[rule]]
+method = "fuzzy"
+target = "/f"
+priority = "high"
+match
+[[rule]]
+method = "regexp"
+match = "^/a/(.*)$"
+target = "/b/$2"
+[[rule]]
+method = "regexp"
+match = "^/a/(.*)$"
+target = "/b/$2"
+expand = false
+`,
+			// Only the last rule is valid: $2 is taken as is
+			rules: []string{"regexp: ^/a/(.*)$ -> /b/$2 (no expand)"},
+			lines: []int{25},
+			errs: []string{
+				"rules:1: unknown table [table], only [[rule]] is supported",
+				"rules:2: method outside of a [[rule]]",
+				"rules:3: rule has no target",
+				"rules:5: match given twice, first on line 4",
+				"rules:6: bogus: unknown key",
+				"rules:11: expand applies to regexp rules only",
+				"rules:14: match: error parsing regexp",
+				"rules:16: rule has no match",
+				"rules:17: method: unknown method fuzzy",
+				"rules:19: priority: unexpected value high",
+				"rules:20: expected key = value",
+				"rules:24: target: $2 in /b/$2 is no capture group of ^/a/(.*)$",
+			},
+		},
+		{
+			name:  "line format errors",
+			file:  "`a` `b`\nx`a` `b`\n`a` `b\nr`(` `b`\n",
+			rules: []string{"hashmap: a -> b"},
+			lines: []int{1},
+			errs: []string{
+				"rules:2: Unknown method: x",
+				"rules:3: Invalid input",
+				"rules:4: error parsing regexp",
+			},
+		},
+	}
+	for _, tt := range tests {
+		rules, errs := parseRules("rules", []byte(tt.file))
+
+		var got []string
+		var lines []int
+		for _, r := range rules {
+			got = append(got, r.String())
+			lines = append(lines, r.line)
+		}
+		if !reflect.DeepEqual(got, tt.rules) || !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("%s: rules %q on lines %v, want %q on lines %v", tt.name, got, lines, tt.rules, tt.lines)
+		}
+
+		if len(errs) != len(tt.errs) {
+			t.Errorf("%s: errors %v, want %q", tt.name, errs, tt.errs)
+			continue
+		}
+		for i, err := range errs {
+			if !strings.HasPrefix(err.Error(), tt.errs[i]) {
+				t.Errorf("%s: error %q, want %q", tt.name, err, tt.errs[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+/*
+ * Ranking of the candidates for the new target of a broken symlink, by how
+ * much they look like the dead target.
+ * */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	. "symutils/common"
+)
+
+// Weights of the scoring model, see score.
+const (
+	suffixWeight  = 2.0 // Per directory in common at the end of the paths
+	sharedWeight  = 1.0 // Per other directory name the paths share
+	siblingWeight = 3.0 // Per former sibling of the dead target found next to the candidate
+	depthWeight   = 0.5 // Per level of depth difference, subtracted
+	baseWeight    = 1.0 // If the base names are the same
+)
+
+type candidate struct {
+	path  string
+	score float64
+}
+
+// Targets of the symlinks in a directory, by the directory they point into.
+// Filled on demand, see siblings.
+var dirTargets = make(map[string]map[string][]string)
+
+// Returns the names of the files that lived next to dst, as told by the other
+// symlinks in the directory of link that point there.
+func siblings(link, dst string) []string {
+	dir := filepath.Dir(link)
+	targets, ok := dirTargets[dir]
+	if !ok {
+		targets = make(map[string][]string)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if e.Type()&os.ModeSymlink == 0 {
+				continue
+			}
+			t, err := os.Readlink(filepath.Join(dir, e.Name()))
+			if err != nil {
+				continue
+			}
+			t = MakeAbsolute(t, dir)
+			targets[filepath.Dir(t)] = append(targets[filepath.Dir(t)], filepath.Base(t))
+		}
+		dirTargets[dir] = targets
+	}
+
+	var names []string
+	for _, name := range targets[filepath.Dir(dst)] {
+		if name != filepath.Base(dst) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func dirComponents(path string) []string {
+	dir := strings.Trim(filepath.Dir(path), string(filepath.Separator))
+	if dir == "" {
+		return nil
+	}
+	return strings.Split(dir, string(filepath.Separator))
+}
+
+// Scores how likely path is the new location of the dead target dst, higher
+// is better. The directories the paths have in common count, especially those
+// right above the files, as do the former siblings of dst found next to path.
+// Differences in depth count against path.
+func score(dst, path string, siblings []string) float64 {
+	d, p := dirComponents(dst), dirComponents(path)
+
+	suffix := 0
+	for suffix < len(d) && suffix < len(p) && d[len(d)-1-suffix] == p[len(p)-1-suffix] {
+		suffix++
+	}
+
+	inPath := make(map[string]bool)
+	for _, c := range p[:len(p)-suffix] {
+		inPath[c] = true
+	}
+	shared := 0
+	for _, c := range d[:len(d)-suffix] {
+		if inPath[c] {
+			shared++
+		}
+	}
+
+	found := 0
+	for _, name := range siblings {
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(path), name)); err == nil {
+			found++
+		}
+	}
+
+	depth := len(d) - len(p)
+	if depth < 0 {
+		depth = -depth
+	}
+
+	s := suffixWeight*float64(suffix) + sharedWeight*float64(shared) + siblingWeight*float64(found) - depthWeight*float64(depth)
+	if filepath.Base(dst) == filepath.Base(path) {
+		s += baseWeight
+	}
+	return s
+}
+
+// Scores the candidates for the broken symlink link -> dst, best first.
+func rank(link, dst string, matches []string) []candidate {
+	sib := siblings(link, dst)
+	cs := make([]candidate, len(matches))
+	for i, m := range matches {
+		cs[i] = candidate{m, score(dst, m, sib)}
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].score != cs[j].score {
+			return cs[i].score > cs[j].score
+		}
+		return cs[i].path < cs[j].path
+	})
+	return cs
+}
+
+func (c candidate) String() string {
+	return fmt.Sprintf("%s (score %.1f)", c.path, c.score)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		dst, path string
+		want      float64
+	}{
+		// Same name, same place
+		{"/a/b/c/f", "/a/b/c/f", 3*suffixWeight + baseWeight},
+		// Moved under another top directory: b and c are in common right above
+		// the file, at the same depth
+		{"/a/b/c/f", "/x/b/c/f", 2*suffixWeight + baseWeight},
+		// a is shared, but not right above the file
+		{"/a/b/c/f", "/a/x/y/f", sharedWeight + baseWeight},
+		// One level deeper, nothing in common
+		{"/a/b/f", "/x/y/z/f", baseWeight - depthWeight},
+		// Two levels shallower, renamed
+		{"/a/b/c/f", "/x/g", -2 * depthWeight},
+		// Renamed, in the same directory
+		{"/a/b/f", "/a/b/g", 2 * suffixWeight},
+	}
+	for _, tt := range tests {
+		if got := score(tt.dst, tt.path, nil); got != tt.want {
+			t.Errorf("score(%q, %q) = %v, want %v", tt.dst, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestScoreSiblings(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"f", "g", "h"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "f")
+	base := score("/gone/f", path, nil)
+	tests := []struct {
+		siblings []string
+		found    int
+	}{
+		{[]string{"g"}, 1},
+		{[]string{"g", "h"}, 2},
+		{[]string{"g", "missing"}, 1},
+		{[]string{"missing"}, 0},
+	}
+	for _, tt := range tests {
+		want := base + siblingWeight*float64(tt.found)
+		if got := score("/gone/f", path, tt.siblings); got != want {
+			t.Errorf("score with siblings %v = %v, want %v", tt.siblings, got, want)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	dir := t.TempDir()
+	links := filepath.Join(dir, "links")
+	moved := filepath.Join(dir, "new", "lib")
+	for _, d := range []string{links, moved, filepath.Join(dir, "other")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"f", "g"} {
+		if err := os.WriteFile(filepath.Join(moved, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both links are broken: lib moved from old/lib to new/lib
+	for _, name := range []string{"f", "g"} {
+		if err := os.Symlink(filepath.Join(dir, "old", "lib", name), filepath.Join(links, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(dir, "old", "lib", "f")
+	other := filepath.Join(dir, "other", "f")
+	cs := rank(filepath.Join(links, "f"), dst, []string{other, filepath.Join(moved, "f")})
+	if cs[0].path != filepath.Join(moved, "f") {
+		t.Fatalf("rank picked %v, want %s", cs, filepath.Join(moved, "f"))
+	}
+	// g, the other link's target, is found next to it
+	if want := score(dst, cs[0].path, nil) + siblingWeight; cs[0].score != want {
+		t.Errorf("score of %s = %v, want %v", cs[0].path, cs[0].score, want)
+	}
+}
@@ -44,6 +44,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"symutils/catalog"
 	. "symutils/common"
 	"symutils/fuzzy"
 	"symutils/locate"
@@ -77,7 +78,14 @@ var (
 	ignoreChars       = flag.String("ignore", "", "Ignore the given set of characters in file names")
 	filter            = flag.String("filter", "", `Filter search results using regexp.MatchString. Separate filters with a newline (\n). If the first character of the filter is !, those that match with the regexp are _not_ listed.`)
 	verbose           = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
-	replaceFile       = flag.String("replace", "", "Name of the file containing replacement rules. To be documented here, for now see replace.go for details.")
+	replaceFile       = flag.String("replace", "", "Name of the file containing replacement rules, used to find new targets when locate finds none. See rules.go for the format, and check the file with symfix check-rules file.")
+	pickMargin        = flag.Float64("margin", 0, "Pick the best candidate without asking if its score beats the next best by this much, zero means never. Candidates score for the directories they share with the dead target (2 per directory in common right above the file, 1 per other), 3 per former sibling of the dead target next to them (known from the other symlinks in the directory), 1 for the same name, minus 0.5 per level of depth difference.")
+	catalogPath       = flag.String("catalog", "", "Sidecar catalogue of target metadata (size, mtime, SHA-256). Targets of healthy links are recorded in it; among the candidates for a broken link, those byte-identical to the recorded target are preferred. Not updated with -n.")
+	snapshotPath      = flag.String("snapshot", "", "Snapshot taken by symsnap(1) while the links were healthy. The targets it hashed are looked up as with -catalog (and added to it, if given).")
+	moveMin           = flag.Uint("moves", 0, "Before fixing the links one by one, look for directory moves: a directory that is gone, with at least this many dead links pointing under it, and candidates at the same relative paths under another directory. Each move is proposed once for the whole group. Zero disables; 3 is a reasonable threshold, lower ones take coincidences for moves.")
+	linkStyle         = flag.String("style", "preserve", LinkStyleUsage)
+	journalPath       = flag.String("journal", DefaultJournalPath(), JournalUsage)
+	dryRun            = flag.Bool("n", false, "Dry run: print the planned actions (relink, rename, delete, skip) with reasons, without changing the filesystem or asking questions")
 
 	searchMethod = flag.String("m", "hashmap",
 		"Comma separated list of search methods: hashmap (exact matches [except for -x and -i options], very fast. Requires a hash-map initialization on first usage.), substring (using strings.Contains), wildcard (using path.Match), regexp, levenshtein (fuzzy search, see -levenshtein option as well). Search will be repeated using the next method if the current method gives 0 hits.")
@@ -85,17 +93,19 @@ var (
 )
 
 var (
-	repaired, deleted, skipped, dead int
-	db                               *locate.DB
-	fileNames                        []string
+	repaired, deleted, skipped, dead, failed int
+	db                                       *locate.DB
+	fileNames                                []string
 
 	missingTargets map[string]bool
 	brokenLinks    map[string]string
+	located        = make(map[string][]string) // Results of mylocate, by pattern
 
 	filterIn  []*regexp.Regexp // Entries that match all these filters will be listed
 	filterOut []*regexp.Regexp // Entries that do not match any of these filters will be listed
 
 	replacer *Replacer
+	journal  *Journal
 )
 
 var (
@@ -110,54 +120,109 @@ const (
 )
 
 func okay(format string, va ...interface{}) bool {
-	if *yesToAll {
+	if *yesToAll || confirmed {
 		return true
 	}
 	return Queryf(format, va...)
 }
 
+/* Reports an action symfix would take in dry-run mode, along with the reason. */
+func plan(action, what, reason string) {
+	fmt.Printf("%s %s: %s\n", action, what, reason)
+}
+
 /* Unlinks the file name. If the target is not an empty string,
    also creates the symlink name (or if renameSymlink option is
-   used, filepath.Base(target)) pointing to it.
+   used, filepath.Base(target)) pointing to it,
+   in the style given by -style.
+   reason tells why target was chosen, for the dry-run mode.
    Depending on the options, the function may expect user-interaction
    to confirm the action. */
-func relink(name, target string) error {
+func relink(name, target, reason string) error {
 	newname := name
 	if *renameSymlink {
 		newname = filepath.Base(name)
 	}
 
 	if target == newname {
+		if *dryRun {
+			plan("skip", name, target+" would point to itself")
+			skipped++
+			return nil
+		}
 		Warnf("Symlink shouldn't be pointing to itself!\n")
 		return ErrCircular
 	}
 
-	if (target == "" && false == okay("Really unlink the file?: %s", name)) ||
-		false == okay("Really relink the file?: %s -> %s", newname, target) {
-		return ErrUserCancel
+	oldtarget, err := os.Readlink(name)
+	if err != nil {
+		return err
+	}
+	if target != "" {
+		if target, err = LinkTarget(*linkStyle, newname, oldtarget, target); err != nil {
+			return err
+		}
 	}
 
-	err := os.Remove(name)
-	if err != nil {
-		Warnf("%v\n", nil)
+	if *dryRun {
+		switch {
+		case target == "":
+			plan("delete", name, reason)
+			deleted++
+		case newname != name:
+			plan("rename", name+" => "+newname+" -> "+target, reason)
+			repaired++
+		default:
+			plan("relink", name+" -> "+target, reason)
+			repaired++
+		}
 		return nil
 	}
 
+	if (target == "" && false == okay("Really unlink the file?: %s", name)) ||
+		false == okay("Really relink the file?: %s -> %s", newname, target) {
+		return ErrUserCancel
+	}
+
 	if target == "" {
+		e := record(name, oldtarget, "", "")
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		done(e)
 		Logf("unlinked %v\n", name)
 		deleted++
 		return nil
 	}
 
-	err = os.Symlink(target, newname)
-	if err != nil {
-		Warnf("%v\n", err)
+	e := record(name, oldtarget, newname, target)
+	if err := ReplaceSymlink(name, newname, target); err != nil {
+		return err
 	}
+	done(e)
 	Printf(LOG, "created symlink: %v -> %v\n", newname, target)
 	repaired++
 	return nil
 }
 
+// Journals a change before it's made. Stops on errors, rather than making
+// changes that can't be undone.
+func record(oldPath, oldTarget, newPath, newTarget string) *JournalEntry {
+	e, err := journal.Begin(oldPath, oldTarget, newPath, newTarget)
+	if err != nil {
+		Errorln("journal:", err)
+	}
+	return e
+}
+
+// Marks a journaled change as made. Stops on errors too, the journal being
+// unusable.
+func done(e *JournalEntry) {
+	if err := journal.Done(e); err != nil {
+		Errorln("journal:", err)
+	}
+}
+
 // Check filename against given filters.
 func filterResult(filename string) bool {
 	Logf("Testing %s against filters", filename)
@@ -178,6 +243,15 @@ func filterResult(filename string) bool {
 }
 
 func mylocate(db *locate.DB, pattern string) (matches []string, err error) {
+	if matches, ok := located[pattern]; ok {
+		return matches, nil
+	}
+	defer func() {
+		if err == nil {
+			located[pattern] = matches
+		}
+	}()
+
 	for _, method := range strings.Split(*searchMethod, ",") {
 		t0 := time.Now()
 		matches, err = locate.LocateAll(db, method, pattern)
@@ -193,9 +267,18 @@ func mylocate(db *locate.DB, pattern string) (matches []string, err error) {
 /* Fixes a given single symlink.
    Returns error code. */
 func symfix(path string) error {
+	if handled[path] {
+		return nil
+	}
+
 	ok, dst, _ := LinkAlive(path, *matchNames)
+	if dst != "" {
+		// The catalogue and the scores expect absolute paths
+		dst = MakeAbsolute(dst, "")
+	}
 	if ok {
 		//Logf("%v -> %v\n", path, dst)
+		remember(dst)
 		return nil
 	}
 
@@ -218,11 +301,13 @@ func symfix(path string) error {
 		Logf("Found candidate: %v\n", f)
 	}
 
+	found := "found by locate"
 	if len(matches) == 0 {
 		Logf("No matches for: %v\n", dst)
 		if replacer != nil {
 			Logln("Using replacement rules to get targets for", dst)
 			matches = replacer.Replace(dst)
+			found = "given by the replacement rules"
 			if len(matches) == 0 {
 				Logln("No matches again")
 			}
@@ -237,29 +322,62 @@ func symfix(path string) error {
 
 		dead++
 		if *deleteDeadLinks {
-			return relink(path, "")
+			return relink(path, "", "no candidates for "+dst)
+		}
+		if *dryRun {
+			plan("skip", path, "no candidates for "+dst+" (-d would delete it)")
 		}
 		return nil
 	}
 
 	if len(matches) == 1 {
-		return relink(path, matches[0])
+		return relink(path, matches[0], "only candidate for "+dst+", "+found)
+	}
+
+	if same := identical(dst, matches); len(same) == 1 {
+		return relink(path, same[0], fmt.Sprintf("the only one of %d candidates for %s with the same contents, per the catalogue", len(matches), dst))
+	} else if len(same) > 1 {
+		Logf("%d candidates have the same contents as %s\n", len(same), dst)
+		matches = same
+	}
+
+	// we have more than 1 match, rank them
+	ranked := rank(path, dst, matches)
+	labels := make([]string, len(ranked))
+	for i, c := range ranked {
+		labels[i] = c.String()
+		Logf("Candidate %v\n", c)
+	}
+
+	lead := ranked[0].score - ranked[1].score
+	if *pickMargin > 0 && lead >= *pickMargin {
+		return relink(path, ranked[0].path, fmt.Sprintf("best of %d candidates for %s, score %.1f, ahead by %.1f", len(ranked), dst, ranked[0].score, lead))
 	}
 
-	// we have more than 1 match
 	if *automatedMode {
 		Logf("Automated mode, skipping results\n")
+		if *dryRun {
+			reason := fmt.Sprintf("%d candidates for %s", len(ranked), dst)
+			if *pickMargin > 0 {
+				reason += fmt.Sprintf(", best ahead by %.1f < -margin %.1f", lead, *pickMargin)
+			}
+			plan("skip", path, reason+", automated mode:\n\t"+strings.Join(labels, "\n\t"))
+		}
 		skipped++
 		return nil
 	}
 
-	choice, cancel := Choose("(Fixing: "+path+" -> "+dst+")\nWhich one seems to be the correct target?", matches)
+	if *dryRun {
+		plan("skip", path, fmt.Sprintf("%d candidates for %s, would ask which one:\n\t%s", len(ranked), dst, strings.Join(labels, "\n\t")))
+		skipped++
+		return nil
+	}
+
+	choice, cancel := Choose("(Fixing: "+path+" -> "+dst+")\nWhich one seems to be the correct target?", labels)
 	if cancel {
 		return ErrUserCancel
 	} //user cancel
-	return relink(path, matches[choice])
-
-	return nil
+	return relink(path, ranked[choice].path, fmt.Sprintf("chosen among %d candidates for %s", len(ranked), dst))
 }
 
 func WalkFunc(path string, info os.FileInfo, err error) error {
@@ -276,14 +394,24 @@ func WalkFunc(path string, info os.FileInfo, err error) error {
 	}
 
 	if info.Mode()&os.ModeSymlink != 0 {
-		if err := symfix(path); err == ErrUserCancel {
-			skipped++
-		}
+		tally(path, symfix(path))
 	}
 
 	return nil
 }
 
+// Counts the outcome of fixing a symlink.
+func tally(path string, err error) {
+	switch err {
+	case nil:
+	case ErrUserCancel:
+		skipped++
+	default:
+		Warnf("%v: %v\n", path, err)
+		failed++
+	}
+}
+
 /* Repair (recursively) symlink(s) */
 func symfixr(filename string) {
 	_, err := os.Stat(filename)
@@ -295,12 +423,19 @@ func symfixr(filename string) {
 	filepath.Walk(filename, WalkFunc)
 }
 
-func init() {
+// Parses the options, and sets up what they ask for. Called from main rather
+// than init, so that the tests can run without arguments.
+func setup() {
 	var err error
 
 	missingTargets = make(map[string]bool)
 	brokenLinks = make(map[string]string)
 
+	if len(os.Args) > 1 && os.Args[1] == "check-rules" {
+		checkRules(os.Args[2:])
+	}
+
+	flag.BoolVar(dryRun, "dry-run", false, "Same as -n")
 	flag.Parse()
 
 	SetLogLevel(*verbose)
@@ -316,6 +451,15 @@ func init() {
 
 	Logf("It's recommended that you update your database files by updatedb(8) prior to execution.\n")
 
+	if err = CheckLinkStyle(*linkStyle); err != nil {
+		Errorln(err)
+	}
+	if !*dryRun {
+		if journal, err = OpenJournal(*journalPath, pkg); err != nil {
+			Errorln("journal:", err)
+		}
+	}
+
 	if *filter != "" {
 		filters := strings.Split(*filter, "\n")
 		filterIn = make([]*regexp.Regexp, 0, len(filters))
@@ -361,7 +505,7 @@ func init() {
 	if *replaceFile != "" {
 		replacer, err = NewReplacer(*replaceFile)
 		if err != nil {
-			log.Fatal(err)
+			Errorln(err)
 		}
 		Logln("Read replacement rules:")
 		for _, r := range replacer.rules {
@@ -372,6 +516,22 @@ func init() {
 		}
 	}
 
+	if *catalogPath != "" {
+		if cat, err = catalog.Load(*catalogPath); err != nil {
+			Errorln(err)
+		}
+	}
+	if *snapshotPath != "" {
+		links, err := catalog.LoadSnapshot(*snapshotPath)
+		if err != nil {
+			Errorln(err)
+		}
+		if cat == nil {
+			cat = catalog.New()
+		}
+		cat.AddLinks(links)
+	}
+
 	Logf("Reading databases...\n")
 	timeStart := time.Now()
 	db, err = locate.NewDB(filepath.SplitList(*dbPath), &options)
@@ -384,7 +544,10 @@ func init() {
 
 func summary() {
 	sprintf := func(format string, va ...interface{}) { fmt.Fprintf(os.Stderr, "[SUMMARY] "+format, va...) }
-	sprintf("Repaired: %d, deleted: %d, skipped: %d, dead: %d\n", repaired, deleted, skipped, dead)
+	if *dryRun {
+		sprintf("Dry run, the following counts are of planned actions\n")
+	}
+	sprintf("Repaired: %d, deleted: %d, skipped: %d, dead: %d, failed: %d\n", repaired, deleted, skipped, dead, failed)
 	sprintf("List of missing targets (%d items):\n", len(missingTargets))
 	for target, _ := range missingTargets {
 		sprintf("%s\n", target)
@@ -397,10 +560,24 @@ func summary() {
 }
 
 func main() {
+	setup()
+
+	if *moveMin > 0 {
+		applyMoves(findMoves(brokenUnder(flag.Args())))
+	}
+
 	for _, f := range flag.Args() {
 		symfixr(f)
 	}
 
+	journal.Close()
+
+	if *catalogPath != "" && !*dryRun {
+		if err := cat.Save(*catalogPath); err != nil {
+			Errorln(err)
+		}
+	}
+
 	if *showSummary {
 		summary()
 	}
@@ -0,0 +1,53 @@
+package main
+
+/*
+ * Content-based verification of the candidates, using a catalogue of the
+ * targets of healthy links (see the -catalog option).
+ * */
+
+import (
+	"os"
+	"symutils/catalog"
+	. "symutils/common"
+)
+
+var cat *catalog.Catalog // nil without -catalog or -snapshot
+
+// Records the target of a healthy link in the catalogue. Without -catalog,
+// there is nothing to keep it in, and the target isn't hashed.
+func remember(target string) {
+	if cat == nil || *catalogPath == "" {
+		return
+	}
+	if _, err := cat.Update(target); err != nil {
+		Warnf("%v\n", err)
+	}
+}
+
+// Returns the candidates byte-identical to what dst was, according to the
+// catalogue. Only those with the right size are hashed.
+func identical(dst string, matches []string) []string {
+	if cat == nil {
+		return nil
+	}
+	old, ok := cat.Get(dst)
+	if !ok {
+		return nil
+	}
+
+	var same []string
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err != nil || fi.Size() != old.Size {
+			continue
+		}
+		e, err := catalog.Stat(m)
+		if err != nil {
+			Warnf("%v\n", err)
+			continue
+		}
+		if e != nil && e.Same(old) {
+			same = append(same, m)
+		}
+	}
+	return same
+}
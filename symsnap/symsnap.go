@@ -0,0 +1,147 @@
+/*
+   Copyright (c) Utkan Güngördü <utkan@freeconsole.org>
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as
+   published by the Free Software Foundation; either version 3 or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+
+   GNU General Public License for more details
+
+
+   You should have received a copy of the GNU General Public
+   License along with this program; if not, write to the
+   Free Software Foundation, Inc.,
+   51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+/*
+symsnap(1) takes snapshots of the symlinks under directories, recording what
+they point to, and compares snapshots.
+
+symsnap [options] dir1 [dir2 ...]
+symsnap -diff old new
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"symutils/catalog"
+	. "symutils/common"
+)
+
+var (
+	outFile     = flag.String("o", "", "Write the snapshot to the given file rather than to the standard output")
+	hashTargets = flag.Bool("hash", true, "Record the SHA-256 of the targets that are regular files, so that symfix(1) can recognize them by their contents (see its -snapshot option)")
+	diffMode    = flag.Bool("diff", false, "Compare two snapshots, old and new, reporting the links that were added, removed, broken or retargeted in between. - reads a snapshot from the standard input. Exits with status 1 if there are differences.")
+	showHelp    = flag.Bool("h", false, "Display help and quit")
+	showVersion = flag.Bool("version", false, "Show version and license info and quit")
+
+	verbose = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
+)
+
+const (
+	pkg, version, author, about, usage string = "symsnap", VERSION, "Utkan Güngördü",
+		"symsnap(1) takes snapshots of the symlinks under directories: their targets, what the targets resolved to, and their size and hash.\n" +
+			"Comparing two snapshots tells which links were added, removed, broken or retargeted in between; symfix(1) can use a snapshot to recognize the moved targets of broken links.",
+		"symsnap [options] dir1 [dir2 ...]\n\tsymsnap -diff old new"
+)
+
+func init() {
+	flag.Parse()
+
+	SetLogLevel(*verbose)
+
+	if *showVersion {
+		PrintVersion(pkg, version, author)
+		os.Exit(0)
+	}
+	if *showHelp || flag.NArg() == 0 || *diffMode && flag.NArg() != 2 {
+		PrintHelp(pkg, version, about, usage)
+		os.Exit(0)
+	}
+}
+
+// Takes a snapshot of the symlinks under the directories.
+func snapshot(dirs []string) []*catalog.Link {
+	var links []*catalog.Link
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				Warnf("%v\n", err)
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+
+			l, err := catalog.SnapLink(path, *hashTargets)
+			if err != nil {
+				Warnf("%v: %v\n", path, err)
+			}
+			if l != nil {
+				links = append(links, l)
+			}
+			return nil
+		})
+	}
+	return links
+}
+
+func load(name string) []*catalog.Link {
+	var links []*catalog.Link
+	var err error
+	if name == "-" {
+		links, err = catalog.ReadSnapshot(os.Stdin, "stdin")
+	} else {
+		links, err = catalog.LoadSnapshot(name)
+	}
+	if err != nil {
+		Errorln(err)
+	}
+	return links
+}
+
+func main() {
+	if *diffMode {
+		changes := catalog.Diff(load(flag.Arg(0)), load(flag.Arg(1)))
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	links := snapshot(flag.Args())
+	Logf("%d symlinks\n", len(links))
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *outFile != "" {
+		var err error
+		if f, err = os.Create(*outFile); err != nil {
+			Errorln(err)
+		}
+		w = f
+	}
+
+	if err := catalog.WriteSnapshot(w, links); err != nil {
+		Errorln(err)
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			Errorln(err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright (c) Utkan Güngördü <utkan@freeconsole.org>
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as
+   published by the Free Software Foundation; either version 3 or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+
+   GNU General Public License for more details
+
+
+   You should have received a copy of the GNU General Public
+   License along with this program; if not, write to the
+   Free Software Foundation, Inc.,
+   51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+/*
+symundo(1) undoes the changes symfix(1) and replsym(1) made to symlinks,
+using their journal.
+
+symundo [options] [journal]
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	. "symutils/common"
+)
+
+var (
+	runID       = flag.String("run", "", "Undo the changes of the given run, rather than of the last one (see -list)")
+	undoAll     = flag.Bool("all", false, "Undo all the changes in the journal, newest first")
+	listRuns    = flag.Bool("list", false, "List the runs in the journal and quit")
+	dryRun      = flag.Bool("n", false, "Dry run: print what would be restored, without changing anything")
+	showHelp    = flag.Bool("h", false, "Display help and quit")
+	showVersion = flag.Bool("version", false, "Show version and license info and quit")
+
+	verbose = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
+)
+
+const (
+	pkg, version, author, about, usage string = "symundo", VERSION, "Utkan Güngördü",
+		"symundo(1) undoes the changes symfix(1) and replsym(1) made to symlinks, using their journal.\n" +
+			"Links that have changed since are left alone. The changes symundo makes are journaled too, so they can be undone in turn.",
+		"symundo [options] [journal]"
+)
+
+var journalPath string
+
+// A run of a command, and the changes it made.
+type run struct {
+	id, tool string
+	entries  []JournalEntry
+}
+
+// Groups the entries by run, in the order the runs started.
+func runs(entries []JournalEntry) []*run {
+	var rs []*run
+	byID := make(map[string]*run)
+	for _, e := range entries {
+		r, ok := byID[e.Run]
+		if !ok {
+			r = &run{id: e.Run, tool: e.Tool}
+			byID[e.Run] = r
+			rs = append(rs, r)
+		}
+		r.entries = append(r.entries, e)
+	}
+	return rs
+}
+
+func init() {
+	flag.Parse()
+
+	SetLogLevel(*verbose)
+
+	if *showVersion {
+		PrintVersion(pkg, version, author)
+		os.Exit(0)
+	}
+	if *showHelp || flag.NArg() > 1 {
+		PrintHelp(pkg, version, about, usage)
+		os.Exit(0)
+	}
+
+	journalPath = DefaultJournalPath()
+	if flag.NArg() == 1 {
+		journalPath = flag.Arg(0)
+	}
+}
+
+func main() {
+	entries, err := ReadJournal(journalPath)
+	if err != nil {
+		Errorln(err)
+	}
+	rs := runs(entries)
+
+	if *listRuns {
+		for _, r := range rs {
+			fmt.Printf("%s %s %s, %d changes\n", r.id, r.tool, r.entries[0].Time.Format("2006-01-02 15:04:05"), len(r.entries))
+		}
+		return
+	}
+
+	var undo []JournalEntry
+	switch {
+	case *undoAll:
+		undo = entries
+	case *runID != "":
+		for _, r := range rs {
+			if r.id == *runID {
+				undo = r.entries
+			}
+		}
+		if undo == nil {
+			Errorln("No such run in", journalPath+":", *runID)
+		}
+	case len(rs) > 0:
+		undo = rs[len(rs)-1].entries
+	}
+
+	var journal *Journal
+	if !*dryRun {
+		if journal, err = OpenJournal(journalPath, pkg); err != nil {
+			Errorln("journal:", err)
+		}
+		defer journal.Close()
+	}
+
+	restored, skipped := 0, 0
+	for i := len(undo) - 1; i >= 0; i-- {
+		e := undo[i]
+		what := e.OldPath + " -> " + e.OldTarget
+		if e.OldPath == "" {
+			what = "remove " + e.NewPath
+		}
+
+		// A pending change may have been left unmade by a crash or an error
+		if e.Pending && e.Check() != nil && e.Unmade() {
+			fmt.Println("skip", what+": the change was never made")
+			continue
+		}
+
+		if *dryRun {
+			if err := e.Check(); err != nil {
+				fmt.Println("skip", what+":", err)
+				skipped++
+			} else {
+				fmt.Println("restore", what)
+				restored++
+			}
+			continue
+		}
+
+		if err := e.Check(); err != nil {
+			fmt.Println("skip", what+":", err)
+			skipped++
+			continue
+		}
+		j, err := journal.Begin(e.NewPath, e.NewTarget, e.OldPath, e.OldTarget)
+		if err != nil {
+			Errorln("journal:", err)
+		}
+		if err := e.Undo(); err != nil {
+			fmt.Println("skip", what+":", err)
+			skipped++
+			continue
+		}
+		if err := journal.Done(j); err != nil {
+			Errorln("journal:", err)
+		}
+		fmt.Println("restored", what)
+		restored++
+	}
+
+	Logf("Restored: %d, skipped: %d\n", restored, skipped)
+	if skipped > 0 {
+		journal.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+// Authentication of daemon clients, and filtering of the results by what the
+// client's user could access.
+//
+// The daemon may run with the privileges of the locate group (see
+// install-xlocate.sh), so without filtering it would list every path in the
+// databases to anyone who can reach it, bypassing mlocate's per-user
+// visibility checks.
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	. "symutils/common"
+	"syscall"
+)
+
+// A user on whose behalf the daemon searches.
+type account struct {
+	Name string
+	Uid  int
+	Gids []int
+}
+
+// Loads the account of a user, given either its name or uid.
+func lookupAccount(name string) (*account, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, err
+		}
+	}
+	return newAccount(u, -1)
+}
+
+// Makes an account of u. gid, if not negative, is added to its groups.
+func newAccount(u *user.User, gid int) (*account, error) {
+	a := &account{Name: u.Username}
+
+	var err error
+	if a.Uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, err
+	}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		groups = []string{u.Gid}
+	}
+	for _, g := range groups {
+		if id, err := strconv.Atoi(g); err == nil {
+			a.Gids = append(a.Gids, id)
+		}
+	}
+	if gid >= 0 {
+		a.Gids = append(a.Gids, gid)
+	}
+	return a, nil
+}
+
+func (a *account) inGroup(gid int) bool {
+	for _, g := range a.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the account has the given permissions (bits of 07) on a file.
+// ACLs and capabilities other than root's are not taken into account.
+func (a *account) can(st *syscall.Stat_t, perm uint32) bool {
+	switch {
+	case a.Uid == 0:
+		return true
+	case int(st.Uid) == a.Uid:
+		perm <<= 6
+	case a.inGroup(int(st.Gid)):
+		perm <<= 3
+	}
+	return st.Mode&perm == perm
+}
+
+// Decides which paths an account can see, the way mlocate does: the
+// directory containing the file must be readable and searchable, and all the
+// directories above it searchable.
+// Results are cached, as matches tend to share directories.
+type visibility struct {
+	account    *account
+	searchDirs map[string]bool // Whether the directory and the ones above it are searchable
+	listDirs   map[string]bool // Whether the directory's entries are visible
+}
+
+func newVisibility(a *account) *visibility {
+	return &visibility{account: a, searchDirs: make(map[string]bool), listDirs: make(map[string]bool)}
+}
+
+// Reports whether the account can search the directory and all the directories above it.
+func (v *visibility) searchable(dir string) bool {
+	if ok, cached := v.searchDirs[dir]; cached {
+		return ok
+	}
+
+	ok := true
+	if parent := filepath.Dir(dir); parent != dir {
+		ok = v.searchable(parent)
+	}
+	if ok {
+		var st syscall.Stat_t
+		ok = syscall.Stat(dir, &st) == nil && v.account.can(&st, 01)
+	}
+	v.searchDirs[dir] = ok
+	return ok
+}
+
+// Reports whether the account can see path.
+func (v *visibility) visible(path string) bool {
+	if v == nil || v.account.Uid == 0 {
+		return true
+	}
+
+	dir := filepath.Dir(path)
+	if ok, cached := v.listDirs[dir]; cached {
+		return ok
+	}
+
+	var st syscall.Stat_t
+	ok := v.searchable(dir) && syscall.Stat(dir, &st) == nil && v.account.can(&st, 04)
+	v.listDirs[dir] = ok
+	return ok
+}
+
+// Wraps fn so that it's called only for the paths visible to v.
+// A nil v lets everything through.
+func (v *visibility) filter(fn func(string)) func(string) {
+	if v == nil {
+		return fn
+	}
+	return func(m string) {
+		if v.visible(m) {
+			fn(m)
+		}
+	}
+}
+
+// Returns the account of the process on the other side of a Unix socket.
+func peerAccount(conn net.Conn) (*account, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a Unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		// A user without a passwd entry: go with what the kernel tells
+		return &account{Name: strconv.Itoa(int(cred.Uid)), Uid: int(cred.Uid), Gids: []int{int(cred.Gid)}}, nil
+	}
+	return newAccount(u, int(cred.Gid))
+}
+
+// Tokens accepted by the HTTP service, and the accounts they stand for.
+var tokens map[string]*account
+
+// Reads a file of "token user" lines, user being a user name or uid.
+// Empty lines and lines starting with # are skipped.
+func loadTokens(filename string) (map[string]*account, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]*account)
+	s := bufio.NewScanner(f)
+	for nline := 1; s.Scan(); nline++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token and a user", filename, nline)
+		}
+		a, err := lookupAccount(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, nline, err)
+		}
+		m[fields[0]] = a
+	}
+	return m, s.Err()
+}
+
+// Looks up the account of a token, comparing in constant time.
+func tokenAccount(token string) *account {
+	var found *account
+	for t, a := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = a
+		}
+	}
+	return found
+}
+
+type accountKey struct{}
+
+// Requires HTTP requests to carry a valid token, either as a bearer token, or
+// as the password of basic authentication (so that browsers can log in),
+// when tokens are in use. The account is stored in the request's context.
+// Static files of the web UI are served to anyone.
+func authHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tokens == nil || strings.HasPrefix(r.URL.Path, "/static/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var a *account
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			a = tokenAccount(strings.TrimPrefix(auth, "Bearer "))
+		} else if name, token, ok := r.BasicAuth(); ok {
+			if a = tokenAccount(token); a != nil && name != a.Name {
+				a = nil
+			}
+		}
+
+		if a == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="xlocate"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountKey{}, a)))
+	})
+}
+
+// Returns the visibility filter for an HTTP request, nil if there's no
+// filtering.
+func requestVisibility(r *http.Request) *visibility {
+	if a, ok := r.Context().Value(accountKey{}).(*account); ok {
+		return newVisibility(a)
+	}
+	return nil
+}
+
+// Returns the visibility filter for a socket client, nil if there's no
+// filtering.
+func connVisibility(conn net.Conn) (*visibility, error) {
+	if !*peerFilter {
+		return nil, nil
+	}
+	a, err := peerAccount(conn)
+	if err != nil {
+		return nil, err
+	}
+	Logf("Serving %s (uid %d)\n", a.Name, a.Uid)
+	return newVisibility(a), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"symutils/locate"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// Writes an mlocate database of the files under root.
+func writeDB(t *testing.T, path, root string) {
+	var b []byte
+	b = append(b, "\x00mlocate\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	b = append(b, root+"\x00"...)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		b = append(b, make([]byte, 16)...)
+		b = append(b, p+"\x00"...)
+		for _, e := range entries {
+			kind := byte(0)
+			if e.IsDir() {
+				kind = 1
+			}
+			b = append(b, kind)
+			b = append(b, e.Name()+"\x00"...)
+		}
+		b = append(b, 2)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Unprivileged account the tests search for, seeing only what others can.
+var nobody = &account{Name: "nobody-test", Uid: 54321, Gids: []int{54321}}
+
+// Makes a tree with a public and a secret file, the latter in a directory
+// only its owner can read, and loads a database of it.
+// Returns the paths of the public and secret files.
+func visibilityTree(t *testing.T) (pub, sec string) {
+	dir := t.TempDir()
+	// t.TempDir makes its directories private
+	for _, d := range []string{filepath.Dir(dir), dir} {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []struct {
+		name string
+		mode os.FileMode
+	}{{"public", 0755}, {"secret", 0700}} {
+		if err := os.Mkdir(filepath.Join(dir, d.name), d.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub, sec = filepath.Join(dir, "public", "file-pub"), filepath.Join(dir, "secret", "file-sec")
+	for _, f := range []string{pub, sec} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	*dbFiles = filepath.Join(dir, "test.db")
+	writeDB(t, *dbFiles, dir)
+	dbOptions = locate.Options{Root: "/", Symlink: true, NWorkers: 1}
+	loadDB()
+	if err := parseTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	return pub, sec
+}
+
+func TestHTTPVisibility(t *testing.T) {
+	pub, sec := visibilityTree(t)
+	tokens = map[string]*account{"root-token": {Name: "root", Uid: 0}, "nobody-token": nobody}
+	defer func() { tokens = nil }()
+	h := newHTTPServer("").Handler
+
+	// Returns the paths in the response to a request for path with token.
+	get := func(path, token string) []string {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return []string{w.Result().Status}
+		}
+
+		var paths []string
+		switch {
+		case strings.HasPrefix(path, "/api/search"):
+			var resp searchResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range resp.Results {
+				paths = append(paths, r.Path)
+			}
+		case strings.HasPrefix(path, "/api/stream"):
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				var ev streamEvent
+				if err := json.Unmarshal([]byte(line), &ev); err != nil {
+					t.Fatal(err)
+				}
+				if ev.Type == "match" {
+					paths = append(paths, ev.Path)
+				}
+			}
+		default:
+			paths = strings.Fields(w.Body.String())
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	for _, path := range []string{
+		"/api/search?q=file-&method=substring",
+		"/api/stream?q=file-&method=substring",
+		"/file-?format=text",
+	} {
+		if got := get(path, "root-token"); strings.Join(got, " ") != pub+" "+sec {
+			t.Errorf("%s as root: %v, want %s and %s", path, got, pub, sec)
+		}
+		if got := get(path, "nobody-token"); strings.Join(got, " ") != pub {
+			t.Errorf("%s as %s: %v, want %s only", path, nobody.Name, got, pub)
+		}
+		if got := get(path, ""); strings.Join(got, " ") != "401 Unauthorized" {
+			t.Errorf("%s without a token: %v, want 401 Unauthorized", path, got)
+		}
+		if got := get(path, "bogus"); strings.Join(got, " ") != "401 Unauthorized" {
+			t.Errorf("%s with a bad token: %v, want 401 Unauthorized", path, got)
+		}
+	}
+}
+
+// Connects to the socket at path with the effective uid and gid set to id.
+// Only the calling thread changes credentials, and only for connecting: the
+// peer credentials of a socket are those it was connected with.
+func dialAs(path string, id int) (net.Conn, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// syscall.Setresuid would change the credentials of every thread
+	keep := ^uintptr(0)
+	if _, _, e := syscall.RawSyscall(syscall.SYS_SETRESGID, keep, uintptr(id), keep); e != 0 {
+		return nil, e
+	}
+	defer syscall.RawSyscall(syscall.SYS_SETRESGID, keep, 0, keep)
+	if _, _, e := syscall.RawSyscall(syscall.SYS_SETRESUID, keep, uintptr(id), keep); e != 0 {
+		return nil, e
+	}
+	defer syscall.RawSyscall(syscall.SYS_SETRESUID, keep, 0, keep)
+
+	return net.Dial("unix", path)
+}
+
+func TestSocketVisibility(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("connecting as another user requires root")
+	}
+	pub, sec := visibilityTree(t)
+
+	*socketMode = 0666
+	path := filepath.Join(filepath.Dir(*dbFiles), "xlocate.sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns sync.WaitGroup
+	go serveSocket(l, &conns)
+	defer l.Close()
+
+	search := func(uid int) []string {
+		conn, err := dialAs(path, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req := &request{Queries: []query{{Pattern: "file-", Methods: []string{"substring"}}}, DBFiles: *dbFiles, Options: dbOptions}
+		if err := json.NewEncoder(conn).Encode(req); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		dec := json.NewDecoder(bufio.NewReader(conn))
+		for {
+			var resp response
+			if err := dec.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Done {
+				if resp.Error != "" {
+					t.Fatal(resp.Error)
+				}
+				break
+			}
+			paths = append(paths, resp.Path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	if got := search(0); strings.Join(got, " ") != pub+" "+sec {
+		t.Errorf("socket as root: %v, want %s and %s", got, pub, sec)
+	}
+	if got := search(nobody.Uid); strings.Join(got, " ") != pub {
+		t.Errorf("socket as uid %d: %v, want %s only", nobody.Uid, got, pub)
+	}
+}
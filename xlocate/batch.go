@@ -0,0 +1,99 @@
+package main
+
+// Batch mode: patterns are read from stdin and searched one after another,
+// reading the databases only once.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	. "symutils/common"
+)
+
+// Results for a pattern, as written with -format json.
+type batchResult struct {
+	Pattern string   `json:"pattern"`
+	Method  string   `json:"method,omitempty"` // The method that found the matches
+	Count   int      `json:"count"`
+	Matches []string `json:"matches,omitempty"` // Left out with -c, or if there are none
+	Error   string   `json:"error,omitempty"`
+}
+
+// Splits NUL terminated entries, for bufio.Scanner.
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Reads patterns from r, one per line (NUL separated with -0), and writes
+// the matches of each pattern as soon as it's searched, so that xlocate can
+// be run as a co-process.
+// In plain and null formats, the matches of a pattern are followed by an
+// empty entry; with -c, the number of matches is written instead. With -format
+// json, a batchResult is written per pattern.
+func runBatch(r io.Reader) {
+	if out.Format == CSVOutput {
+		Errorln("Batch mode supports the plain, null and json formats only")
+	}
+
+	in := bufio.NewScanner(r)
+	if *nullSep {
+		in.Split(scanNull)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	methods := strings.Split(*searchMethod, ",")
+
+	for in.Scan() {
+		res := &batchResult{Pattern: in.Text()}
+
+		emit := func(m string) {
+			if *limit > 0 && uint(res.Count) >= *limit {
+				return
+			}
+			res.Count++
+			switch {
+			case *countEntries:
+			case out.Format == JSONOutput:
+				res.Matches = append(res.Matches, m)
+			case *textTemplateString != "":
+				textTpl.Execute(os.Stdout, newMatch(res.Count, m, currentDB(), []string{res.Pattern}))
+			default:
+				out.Write(Record{Path: m})
+			}
+		}
+
+		if res.Pattern != "" { // Would match everything
+			_, method, err := search(currentDB(), nil, query{Pattern: res.Pattern, Methods: methods}, emit)
+			if err != nil {
+				res.Error = err.Error()
+				if out.Format != JSONOutput {
+					Warnln(res.Pattern+":", err)
+				}
+			} else if res.Count > 0 {
+				res.Method = method
+			}
+		}
+
+		switch {
+		case out.Format == JSONOutput:
+			enc.Encode(res)
+		case *countEntries:
+			out.Write(Record{Path: fmt.Sprint(res.Count)})
+		default:
+			out.Write(Record{}) // Ends the group
+		}
+	}
+
+	if err := in.Err(); err != nil {
+		Errorln(err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+// Results of recent queries, kept by the daemon so that repeated searches
+// don't scan the databases again.
+// Results are cached before filtering them for the user (see auth.go), and
+// the cache is emptied when the databases are reloaded. Files created or
+// removed in between aren't noticed, so queries with -e (Existing) aren't
+// cached.
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"symutils/locate"
+	"sync"
+)
+
+// Queries with more matches than this aren't cached.
+const maxCachedMatches = 100000
+
+type cacheEntry struct {
+	key     string
+	db      *locate.DB // The databases the results come from
+	method  string     // The method that found the matches
+	matches []string
+}
+
+// A least recently used cache of query results. A nil cache caches nothing.
+type resultCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element // of *cacheEntry
+	lru     *list.List               // Most recently used first
+}
+
+// The daemon's cache, nil when not running as a daemon or with -cache 0.
+var cache *resultCache
+
+func newResultCache(size int) *resultCache {
+	if size <= 0 {
+		return nil
+	}
+	return &resultCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Identifies a query along with the options affecting its results.
+func cacheKey(q query, options *locate.Options) string {
+	o := *options
+	o.NWorkers, o.HashMap = 0, false
+	return fmt.Sprintf("%q %s %+v", q.Pattern, strings.Join(q.Methods, ","), o)
+}
+
+// Returns the results for key, if they were found in db.
+func (c *resultCache) get(db *locate.DB, key string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok || el.Value.(*cacheEntry).db != db {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *resultCache) add(e *cacheEntry) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// Empties the cache.
+func (c *resultCache) reset() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Returns the number of cached queries.
+func (c *resultCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
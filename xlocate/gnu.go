@@ -0,0 +1,404 @@
+package main
+
+// GNU locate compatible command line.
+// When invoked as locate (or with --gnu as the first argument), xlocate parses
+// its arguments the way GNU locate and mlocate do: short options can be
+// clustered, long options can be abbreviated, options and patterns can be
+// mixed, and patterns are matched the way locate(1) matches them.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	. "symutils/common"
+)
+
+const gnuUsage = `Usage: locate [OPTION]... [PATTERN]...
+Search for entries in a mlocate database.
+
+  -A, --all              only print entries that match all patterns
+  -b, --basename         match only the base name of path names
+  -c, --count            only print number of found entries
+  -d, --database DBPATH  use DBPATH instead of default database (which is
+                         ` + DBFILES + `)
+  -e, --existing         only print entries for currently existing files
+  -L, --follow           follow trailing symbolic links when checking file
+                         existence (default)
+  -h, --help             print this help
+  -i, --ignore-case      ignore case distinctions when matching patterns
+  -l, --limit, -n LIMIT  limit output (or counting) to LIMIT entries
+  -m, --mmap             ignored, for backward compatibility
+  -P, --nofollow, -H     don't follow trailing symbolic links when checking file
+                         existence
+  -0, --null             separate entries with NUL on output
+  -S, --statistics       don't search for entries, print statistics about each
+                         used database
+  -q, --quiet            report no error messages about reading databases
+  -r, --regexp REGEXP    search for basic regexp REGEXP instead of patterns
+      --regex            patterns are extended regexps
+      --regextype TYPE   regexp dialect used by --regexp and --regex
+  -s, --stdio            ignored, for backward compatibility
+  -V, --version          print version information
+  -w, --wholename        match whole path name (default)
+`
+
+// A GNU locate option.
+type gnuOption struct {
+	short  byte   // Short form, 0 if none
+	long   string // Long form, "" if none
+	hasArg bool
+	set    func(arg string) error
+}
+
+var (
+	gnuMode   bool     // Whether the command line was parsed by parseGNU
+	quiet     bool     // Report no errors (-q)
+	regexps   []string // Arguments of -r
+	regexMode bool     // Patterns are extended regexps (--regex)
+	regexType string   // Regexp dialect (--regextype)
+)
+
+// Reports whether xlocate was invoked as GNU locate, and strips --gnu from
+// the arguments if that's how it was requested.
+func gnuInvocation() bool {
+	if len(os.Args) > 1 && (os.Args[1] == "--gnu" || os.Args[1] == "-gnu") {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		return true
+	}
+	return filepath.Base(os.Args[0]) == "locate"
+}
+
+func gnuOptions() []gnuOption {
+	set := func(b *bool, v bool) func(string) error {
+		return func(string) error { *b = v; return nil }
+	}
+	ignore := func(string) error { return nil }
+
+	return []gnuOption{
+		{'A', "all", false, set(matchAll, true)},
+		{'b', "basename", false, set(stripPath, true)},
+		{'c', "count", false, set(countEntries, true)},
+		{'d', "database", true, func(arg string) error {
+			if *dbFiles == "" {
+				*dbFiles = arg
+			} else {
+				*dbFiles += ":" + arg
+			}
+			return nil
+		}},
+		{'e', "existing", false, set(existing, true)},
+		{'L', "follow", false, set(follow, true)},
+		{'h', "help", false, set(showHelp, true)},
+		{'i', "ignore-case", false, set(ignoreCase, true)},
+		{'l', "limit", true, gnuLimit},
+		{'n', "", true, gnuLimit},
+		{'m', "mmap", false, ignore},
+		{'P', "nofollow", false, set(follow, false)},
+		{'H', "", false, set(follow, false)},
+		{'0', "null", false, set(nullSep, true)},
+		{'S', "statistics", false, set(statistics, true)},
+		{'q', "quiet", false, set(&quiet, true)},
+		{'r', "regexp", true, func(arg string) error { regexps = append(regexps, arg); return nil }},
+		{0, "regex", false, set(&regexMode, true)},
+		{0, "regextype", true, func(arg string) error { regexType = arg; return nil }},
+		{'s', "stdio", false, ignore},
+		{'V', "version", false, set(showVersion, true)},
+		{'w', "wholename", false, set(stripPath, false)},
+	}
+}
+
+func gnuLimit(arg string) error {
+	n, err := strconv.ParseUint(arg, 10, 0)
+	if err != nil {
+		return fmt.Errorf("invalid value `%s' of --limit", arg)
+	}
+	*limit = uint(n)
+	return nil
+}
+
+// Looks up a long option, allowing unambiguous abbreviations like getopt_long does.
+func lookupLong(options []gnuOption, name string) (*gnuOption, error) {
+	var found *gnuOption
+	for i := range options {
+		o := &options[i]
+		if o.long == "" || !strings.HasPrefix(o.long, name) {
+			continue
+		}
+		if o.long == name {
+			return o, nil
+		}
+		if found != nil {
+			return nil, fmt.Errorf("option `--%s' is ambiguous", name)
+		}
+		found = o
+	}
+	if found == nil {
+		return nil, fmt.Errorf("unrecognized option `--%s'", name)
+	}
+	return found, nil
+}
+
+func lookupShort(options []gnuOption, c byte) (*gnuOption, error) {
+	for i := range options {
+		if options[i].short == c {
+			return &options[i], nil
+		}
+	}
+	return nil, fmt.Errorf("invalid option -- '%c'", c)
+}
+
+// Parses a GNU locate command line, setting the corresponding xlocate flags.
+// Returns the patterns found among the arguments.
+func parseGNU(args []string) (patterns []string, err error) {
+	gnuMode = true
+	*dbFiles = ""
+	*follow = true // GNU locate's default, unlike ours
+	*searchMethod = "substring"
+
+	options := gnuOptions()
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case arg == "--":
+			patterns = append(patterns, args[i+1:]...)
+			i = len(args)
+
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg[2:], ""
+			hasValue := false
+			if j := strings.Index(name, "="); j >= 0 {
+				name, value, hasValue = name[:j], name[j+1:], true
+			}
+			o, err := lookupLong(options, name)
+			if err != nil {
+				return nil, err
+			}
+			if o.hasArg && !hasValue {
+				if i+1 == len(args) {
+					return nil, fmt.Errorf("option `--%s' requires an argument", o.long)
+				}
+				i++
+				value = args[i]
+			} else if !o.hasArg && hasValue {
+				return nil, fmt.Errorf("option `--%s' doesn't allow an argument", o.long)
+			}
+			if err := o.set(value); err != nil {
+				return nil, err
+			}
+
+		case len(arg) > 1 && arg[0] == '-':
+			for j := 1; j < len(arg); j++ {
+				o, err := lookupShort(options, arg[j])
+				if err != nil {
+					return nil, err
+				}
+				value := ""
+				if o.hasArg {
+					if j+1 < len(arg) {
+						value = arg[j+1:]
+					} else if i+1 < len(args) {
+						i++
+						value = args[i]
+					} else {
+						return nil, fmt.Errorf("option requires an argument -- '%c'", o.short)
+					}
+					j = len(arg)
+				}
+				if err := o.set(value); err != nil {
+					return nil, err
+				}
+			}
+
+		default:
+			patterns = append(patterns, arg)
+		}
+	}
+
+	if *dbFiles == "" {
+		*dbFiles = DBFILES
+	}
+	if env := os.Getenv("LOCATE_PATH"); env != "" {
+		*dbFiles += ":" + env
+	}
+
+	return patterns, nil
+}
+
+// Builds the queries for the patterns of a GNU command line.
+// Patterns with no globbing characters match as substrings, others must match
+// the whole path (or base name with -b). --regex and -r arguments are regexps.
+func gnuQueries(patterns []string) (queries []query, err error) {
+	if len(regexps) > 0 && len(patterns) > 0 {
+		return nil, errors.New("non-option arguments are not allowed with --regexp")
+	}
+
+	for _, re := range regexps {
+		if re, err = gnuRegexp(re, regexType, "posix-basic"); err != nil {
+			return nil, err
+		}
+		queries = append(queries, query{Pattern: re, Methods: []string{"regexp"}})
+	}
+
+	for _, p := range patterns {
+		switch {
+		case regexMode:
+			if p, err = gnuRegexp(p, regexType, "posix-extended"); err != nil {
+				return nil, err
+			}
+			queries = append(queries, query{Pattern: p, Methods: []string{"regexp"}})
+		case strings.ContainsAny(p, "*?["):
+			queries = append(queries, query{Pattern: globToRegexp(p), Methods: []string{"regexp"}})
+		default:
+			queries = append(queries, query{Pattern: p, Methods: []string{"substring"}})
+		}
+	}
+
+	return queries, nil
+}
+
+// Converts a regexp in the given dialect (or def, if dialect is empty) into
+// the syntax of Go's regexp package.
+func gnuRegexp(re, dialect, def string) (string, error) {
+	if dialect == "" {
+		dialect = def
+	}
+
+	var err error
+	switch dialect {
+	case "posix-basic", "posix-minimal-basic", "grep", "sed", "ed", "emacs":
+		re = breToERE(re)
+	case "posix-extended", "posix-egrep", "egrep", "posix-awk", "awk", "gnu-awk", "findutils-default":
+	default:
+		return "", fmt.Errorf("unsupported regexp type `%s'", dialect)
+	}
+
+	_, err = regexp.Compile(re)
+	return re, err
+}
+
+// Converts a POSIX basic regexp into an extended one by swapping the meaning
+// of escaped and bare (, ), {, }, |, + and ?.
+// Bracket expressions are copied as they are.
+func breToERE(re string) string {
+	const swapped = "(){}|+?"
+
+	b := make([]byte, 0, len(re))
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+		switch {
+		case c == '\\' && i+1 < len(re):
+			i++
+			if strings.IndexByte(swapped, re[i]) >= 0 {
+				b = append(b, re[i])
+			} else {
+				b = append(b, '\\', re[i])
+			}
+		case strings.IndexByte(swapped, c) >= 0:
+			b = append(b, '\\', c)
+		case c == '[':
+			j := bracketEnd(re, i)
+			b = append(b, re[i:j]...)
+			i = j - 1
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// Returns the index just after the bracket expression starting at re[i].
+func bracketEnd(re string, i int) int {
+	j := i + 1
+	if j < len(re) && (re[j] == '^' || re[j] == '!') {
+		j++
+	}
+	if j < len(re) && re[j] == ']' {
+		j++
+	}
+	for ; j < len(re); j++ {
+		if re[j] == ']' {
+			return j + 1
+		}
+	}
+	return len(re)
+}
+
+// Converts a fnmatch(3) pattern (without FNM_PATHNAME, so that * and ? match /
+// as well) into an anchored regexp.
+func globToRegexp(glob string) string {
+	b := []byte("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			b = append(b, ".*"...)
+		case '?':
+			b = append(b, '.')
+		case '[':
+			j := bracketEnd(glob, i)
+			if j == len(glob) && glob[j-1] != ']' {
+				b = append(b, `\[`...) // unterminated, match literally
+				continue
+			}
+			class := glob[i+1 : j-1]
+			b = append(b, '[')
+			if len(class) > 0 && class[0] == '!' {
+				b = append(b, '^')
+				class = class[1:]
+			}
+			b = append(b, strings.Replace(class, `\`, `\\`, -1)...)
+			b = append(b, ']')
+			i = j - 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			b = append(b, regexp.QuoteMeta(string(c))...)
+		default:
+			b = append(b, regexp.QuoteMeta(string(c))...)
+		}
+	}
+	return string(append(b, '$'))
+}
+
+// Sets up xlocate according to a GNU locate command line.
+// Exits on errors and when there's nothing to search for.
+func initGNU() {
+	fail := func(err error) {
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		}
+		os.Exit(1)
+	}
+
+	patterns, err := parseGNU(os.Args[1:])
+	if err != nil {
+		fail(err)
+	}
+
+	if *showHelp {
+		fmt.Print(gnuUsage)
+		os.Exit(0)
+	}
+	if *showVersion {
+		PrintVersion(pkg, version, author)
+		os.Exit(0)
+	}
+
+	if quiet {
+		LogLevel = LogLevelType(ERR - 1) // not even errors
+	}
+
+	if queries, err = gnuQueries(patterns); err != nil {
+		fail(err)
+	}
+	if len(queries) == 0 && !*statistics {
+		fail(errors.New("no pattern to search for specified"))
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	. "symutils/common"
+	"testing"
+)
+
+// Sets xlocate's flags, and the state parseGNU keeps besides them, back to
+// their defaults.
+func resetFlags(t *testing.T) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+		if err := f.Value.Set(f.DefValue); err != nil {
+			t.Fatal(err)
+		}
+	})
+	gnuMode, quiet, regexps, regexMode, regexType = false, false, nil, false, ""
+}
+
+// What a GNU command line sets.
+type gnuState struct {
+	DBFiles    string
+	Limit      uint
+	All        bool
+	Basename   bool
+	Count      bool
+	Existing   bool
+	Follow     bool
+	IgnoreCase bool
+	Null       bool
+	Quiet      bool
+	Regexps    []string
+	RegexMode  bool
+	RegexType  string
+}
+
+func currentGNUState() gnuState {
+	return gnuState{
+		DBFiles:    *dbFiles,
+		Limit:      *limit,
+		All:        *matchAll,
+		Basename:   *stripPath,
+		Count:      *countEntries,
+		Existing:   *existing,
+		Follow:     *follow,
+		IgnoreCase: *ignoreCase,
+		Null:       *nullSep,
+		Quiet:      quiet,
+		Regexps:    regexps,
+		RegexMode:  regexMode,
+		RegexType:  regexType,
+	}
+}
+
+func TestParseGNU(t *testing.T) {
+	// Returns the state of a command line with no options, changed by fn.
+	state := func(fn func(s *gnuState)) gnuState {
+		s := gnuState{DBFiles: DBFILES, Follow: true}
+		if fn != nil {
+			fn(&s)
+		}
+		return s
+	}
+
+	for _, c := range []struct {
+		args     []string
+		env      string // $LOCATE_PATH
+		patterns []string
+		want     gnuState
+	}{
+		{[]string{"foo"}, "", []string{"foo"}, state(nil)},
+		{[]string{"-0", "-c", "foo", "bar"}, "", []string{"foo", "bar"}, state(func(s *gnuState) { s.Null, s.Count = true, true })},
+		{[]string{"a", "-i", "b"}, "", []string{"a", "b"}, state(func(s *gnuState) { s.IgnoreCase = true })},
+		{[]string{"-icb0", "x"}, "", []string{"x"}, state(func(s *gnuState) {
+			s.IgnoreCase, s.Count, s.Basename, s.Null = true, true, true, true
+		})},
+		{[]string{"-l5", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Limit = 5 })},
+		{[]string{"-l", "5", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Limit = 5 })},
+		{[]string{"-n", "7", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Limit = 7 })},
+		{[]string{"--limit=3", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Limit = 3 })},
+		{[]string{"--lim", "3", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Limit = 3 })},
+		{[]string{"-cl2", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Count, s.Limit = true, 2 })},
+		{[]string{"-e", "-P", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Existing, s.Follow = true, false })},
+		{[]string{"-H", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Follow = false })},
+		{[]string{"-P", "-L", "x"}, "", []string{"x"}, state(nil)},
+		{[]string{"--existing", "--nofollow", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Existing, s.Follow = true, false })},
+		{[]string{"-b", "-w", "x"}, "", []string{"x"}, state(nil)},
+		{[]string{"-A", "x", "y"}, "", []string{"x", "y"}, state(func(s *gnuState) { s.All = true })},
+		{[]string{"-mqs", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.Quiet = true })},
+		{[]string{"-d", "/a.db", "--database=/b.db", "-d/c.db", "x"}, "", []string{"x"}, state(func(s *gnuState) { s.DBFiles = "/a.db:/b.db:/c.db" })},
+		{[]string{"x"}, "/e.db", []string{"x"}, state(func(s *gnuState) { s.DBFiles = DBFILES + ":/e.db" })},
+		{[]string{"-d", "/a.db", "x"}, "/e.db", []string{"x"}, state(func(s *gnuState) { s.DBFiles = "/a.db:/e.db" })},
+		{[]string{"-i", "--", "-c", "--x"}, "/e.db", []string{"-c", "--x"}, state(func(s *gnuState) { s.IgnoreCase, s.DBFiles = true, DBFILES+":/e.db" })},
+		{[]string{"-", "x"}, "", []string{"-", "x"}, state(nil)},
+		{[]string{"-r", `a\(b\)`, "--regextype", "egrep"}, "", nil, state(func(s *gnuState) { s.Regexps, s.RegexType = []string{`a\(b\)`}, "egrep" })},
+		{[]string{"--regex", "a+"}, "", []string{"a+"}, state(func(s *gnuState) { s.RegexMode = true })},
+	} {
+		resetFlags(t)
+		t.Setenv("LOCATE_PATH", c.env)
+
+		patterns, err := parseGNU(c.args)
+		if err != nil {
+			t.Errorf("parseGNU(%q): %v", c.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(patterns, c.patterns) {
+			t.Errorf("parseGNU(%q) = %q, want %q", c.args, patterns, c.patterns)
+		}
+		if got := currentGNUState(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseGNU(%q) sets\n%+v, want\n%+v", c.args, got, c.want)
+		}
+		if !gnuMode {
+			t.Errorf("parseGNU(%q) doesn't set gnuMode", c.args)
+		}
+	}
+}
+
+func TestParseGNUErrors(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-x"}, "invalid option -- 'x'"},
+		{[]string{"-ix"}, "invalid option -- 'x'"},
+		{[]string{"--nope"}, "unrecognized option `--nope'"},
+		{[]string{"--re", "x"}, "option `--re' is ambiguous"},
+		{[]string{"-l"}, "option requires an argument -- 'l'"},
+		{[]string{"-il"}, "option requires an argument -- 'l'"},
+		{[]string{"x", "--limit"}, "option `--limit' requires an argument"},
+		{[]string{"--count=1", "x"}, "option `--count' doesn't allow an argument"},
+		{[]string{"-l", "five", "x"}, "invalid value `five' of --limit"},
+		{[]string{"-lc", "x"}, "invalid value `c' of --limit"},
+	} {
+		resetFlags(t)
+		if _, err := parseGNU(c.args); err == nil || err.Error() != c.err {
+			t.Errorf("parseGNU(%q): got error %v, want %q", c.args, err, c.err)
+		}
+	}
+}
+
+func TestGNUQueries(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want []query // nil for an error
+	}{
+		{[]string{"foo", "a.b"}, []query{{"foo", []string{"substring"}}, {"a.b", []string{"substring"}}}},
+		{[]string{"*.go"}, []query{{`^.*\.go$`, []string{"regexp"}}}},
+		{[]string{"--regex", "a+b", "x|y"}, []query{{"a+b", []string{"regexp"}}, {"x|y", []string{"regexp"}}}},
+		{[]string{"--regex", "--regextype", "ed", `a\+b`}, []query{{"a+b", []string{"regexp"}}}},
+		{[]string{"-r", `a\(b\|c\)+`}, []query{{`a(b|c)\+`, []string{"regexp"}}}},
+		{[]string{"-r", "a+", "--regextype=egrep"}, []query{{"a+", []string{"regexp"}}}},
+		{[]string{"-r", "a", "-r", "b"}, []query{{"a", []string{"regexp"}}, {"b", []string{"regexp"}}}},
+		{[]string{"-r", "a", "b"}, nil},
+		{[]string{"-r", "a", "--regextype", "perl"}, nil},
+		{[]string{"--regex", "a("}, nil},
+	} {
+		resetFlags(t)
+		patterns, err := parseGNU(c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gnuQueries(patterns)
+		switch {
+		case c.want == nil && err == nil:
+			t.Errorf("gnuQueries for %q = %v, want an error", c.args, got)
+		case c.want != nil && err != nil:
+			t.Errorf("gnuQueries for %q: %v", c.args, err)
+		case c.want != nil && !reflect.DeepEqual(got, c.want):
+			t.Errorf("gnuQueries for %q = %v, want %v", c.args, got, c.want)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	for _, c := range []struct{ glob, want string }{
+		{"*.go", `^.*\.go$`},
+		{"a?c", `^a.c$`},
+		{"[abc]*", `^[abc].*$`},
+		{"[!a-z]", `^[^a-z]$`},
+		{"[]]", `^[]]$`},
+		{"[a", `^\[a$`},
+		{`\*x`, `^\*x$`},
+		{`x\`, `^x\\$`},
+		{"a+b(c)", `^a\+b\(c\)$`},
+	} {
+		if got := globToRegexp(c.glob); got != c.want {
+			t.Errorf("globToRegexp(%q) = %q, want %q", c.glob, got, c.want)
+		}
+	}
+}
+
+func TestBreToERE(t *testing.T) {
+	for _, c := range []struct{ bre, want string }{
+		{"abc", "abc"},
+		{`a\(b\)`, "a(b)"},
+		{"a(b)", `a\(b\)`},
+		{`a\{2\}`, "a{2}"},
+		{`a\|b`, "a|b"},
+		{"a+?", `a\+\?`},
+		{`\.x`, `\.x`},
+		{"[(|)]", "[(|)]"},
+		{`[]\(]`, `[]\(]`},
+	} {
+		if got := breToERE(c.bre); got != c.want {
+			t.Errorf("breToERE(%q) = %q, want %q", c.bre, got, c.want)
+		}
+	}
+}
+
+// Runs a GNU command line on a small tree, and compares what it lists with
+// the expected output.
+func TestGNUOutput(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"sub", "alphabet"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"alpha.go", "beta.txt", "sub/gamma.go", "sub/Delta.GO"} {
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"dangling": "nowhere", "link": "gamma.go"} {
+		if err := os.Symlink(target, filepath.Join(dir, "sub", link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := filepath.Join(dir, "test.db")
+	writeDB(t, db, dir)
+	if err := os.Remove(filepath.Join(dir, "beta.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string // @ stands for the tree
+	}{
+		{[]string{".go"}, "@/alpha.go\n@/sub/gamma.go\n"},
+		{[]string{"-i", ".go"}, "@/alpha.go\n@/sub/Delta.GO\n@/sub/gamma.go\n"},
+		{[]string{"-0", ".go"}, "@/alpha.go\x00@/sub/gamma.go\x00"},
+		{[]string{"-c", "-i", ".go"}, "3\n"},
+		{[]string{"-ic", "nothing"}, "0\n"},
+		{[]string{"-l", "1", ".go"}, "@/alpha.go\n"},
+		{[]string{"-cl2", "-i", ".go"}, "2\n"},
+		{[]string{"-c", "beta"}, "1\n"},
+		{[]string{"-ce", "beta"}, "0\n"},
+		{[]string{"alpha"}, "@/alpha.go\n@/alphabet\n"},
+		{[]string{"-b", "alpha*"}, "@/alpha.go\n@/alphabet\n"},
+		{[]string{"alpha*"}, ""},
+		{[]string{"-w", "*/alpha*"}, "@/alpha.go\n@/alphabet\n"},
+		{[]string{"*.go"}, "@/alpha.go\n@/sub/gamma.go\n"},
+		{[]string{"-A", "sub", "-i", ".go"}, "@/sub/Delta.GO\n@/sub/gamma.go\n"},
+		{[]string{"--regex", `/(alpha|beta)\.`}, "@/alpha.go\n@/beta.txt\n"},
+		{[]string{"-r", `/\(alpha\|beta\)\.`, "-e"}, "@/alpha.go\n"},
+		{[]string{"dangling"}, "@/sub/dangling\n"},
+		{[]string{"-e", "dangling"}, ""},
+		{[]string{"-eL", "dangling"}, ""},
+		{[]string{"-eL", "link"}, "@/sub/link\n"},
+	} {
+		resetFlags(t)
+		t.Setenv("LOCATE_PATH", "")
+
+		patterns, err := parseGNU(append([]string{"-d", db}, c.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queries, err = gnuQueries(patterns); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if out, err = NewOutput(&b, *outputFormat, *nullSep); err != nil {
+			t.Fatal(err)
+		}
+		dbOptions = flagOptions()
+		loadDB()
+
+		var n uint
+		if err := searchAll(currentDB(), queries, *matchAll, lister(&b, patterns, &n)); err != nil {
+			t.Fatal(err)
+		}
+		if *countEntries {
+			fmt.Fprintln(&b, n)
+		}
+
+		want := strings.Replace(c.want, "@", dir, -1)
+		if got := b.String(); got != want {
+			t.Errorf("locate %s:\n%q\nwant\n%q", strings.Join(c.args, " "), got, want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+// HTTP service of xlocate: a web UI at /, an HTML page of results for each
+// pattern (http://host:port/pattern) and a JSON search API under /api/
+// (streaming results with /api/stream, see stream.go).
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	. "symutils/common"
+	"symutils/locate"
+	"time"
+)
+
+// The web UI, served at / and /static/.
+//
+//go:embed web
+var webFS embed.FS
+
+// Configuration of the daemon, served at /api/config for the web UI.
+type Config struct {
+	StripPath         bool
+	CountEntries      bool
+	DBFiles           string
+	Existing          bool
+	Follow            bool
+	IgnoreCase        bool
+	Limit             uint
+	Accessable        bool
+	LevenshteinParams string
+	SearchMethod      string
+	Methods           []string // Available search methods
+	StripExtension    bool
+	BasenameMustMatch bool
+	SymlinkCandidates bool
+	HttpAddr          string
+	TemplateString    string
+	TextTemplate      string
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	c := &Config{
+		StripPath:         *stripPath,
+		CountEntries:      *countEntries,
+		DBFiles:           *dbFiles,
+		Existing:          *existing,
+		Follow:            *follow,
+		IgnoreCase:        *ignoreCase,
+		Limit:             *limit,
+		Accessable:        *accessable,
+		LevenshteinParams: *levenshteinParams,
+		SearchMethod:      *searchMethod,
+		Methods:           locate.Methods,
+		StripExtension:    *stripExtension,
+		BasenameMustMatch: *basenameMustMatch,
+		SymlinkCandidates: *symlinkCandidates,
+		HttpAddr:          *httpAddr,
+		TemplateString:    *templateString,
+		TextTemplate:      *textTemplateString,
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// Number of matches rendered per page by handler, unless ?limit is given.
+const pageSize = 100
+
+// Handles /pattern[?offset=n][&limit=n], rendering the matches on the page
+// with the HTML template, or with the text template for ?format=text.
+// Matches are sorted like for /api/search; limit=0 renders them all. Only
+// the matches on the page are stat'ed and scored, see newMatch.
+func handler(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Path[1:]
+
+	if pattern == "" {
+		http.ServeFileFS(w, r, webFS, "web/index.html")
+		return
+	}
+
+	text := r.FormValue("format") == "text"
+	fail := func(status int, err error) {
+		if text {
+			http.Error(w, err.Error(), status)
+		} else {
+			http.Error(w, html.EscapeString(err.Error()), status)
+		}
+	}
+
+	offset, err := formUint(r, "offset", 0)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	limit, err := formUint(r, "limit", pageSize)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	db := currentDB()
+	var matches []string
+	q := query{Pattern: pattern, Methods: strings.Split(*searchMethod, ",")}
+	_, _, err = search(db, nil, q, requestVisibility(r).filter(func(p string) {
+		matches = append(matches, p)
+	}))
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	sort.Strings(matches)
+	end := len(matches)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+
+	if text {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	for i := offset; i < end; i++ {
+		m := newMatch(i+1, matches[i], db, []string{pattern})
+		if text {
+			textTpl.Execute(w, m)
+		} else {
+			htmlTpl.Execute(w, m)
+		}
+	}
+
+	if !text && end < len(matches) {
+		next := url.Values{"offset": {fmt.Sprint(end)}, "limit": {fmt.Sprint(limit)}}
+		fmt.Fprintf(w, "<a href=\"?%s\">Next %d of %d matches</a>\n", html.EscapeString(next.Encode()), len(matches)-end, len(matches))
+	}
+}
+
+// Response of the /api/search endpoint.
+type searchResponse struct {
+	Query   string   `json:"query"`
+	Method  string   `json:"method,omitempty"` // Method that found the results
+	Total   int      `json:"total"`            // Number of matches, regardless of offset and limit
+	Offset  int      `json:"offset"`
+	Limit   int      `json:"limit"`
+	Elapsed float64  `json:"elapsed"` // Search time in seconds
+	Results []Record `json:"results"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Parses a non-negative integer form value, def if it's missing.
+func formUint(r *http.Request, name string, def int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return int(n), nil
+}
+
+// Returns the options for a search request: the daemon's, overridden by the
+// icase, basename, existing, follow and symlinks form values (1 or 0).
+func requestOptions(r *http.Request, db *locate.DB) (*locate.Options, error) {
+	o := db.Options()
+	toggles := map[string]*bool{
+		"icase":    &o.IgnoreCase,
+		"basename": &o.StripPath,
+		"existing": &o.Existing,
+		"follow":   &o.Follow,
+		"symlinks": &o.Symlink,
+	}
+	for name, p := range toggles {
+		if v := r.FormValue(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			*p = b
+		}
+	}
+	return &o, nil
+}
+
+// Returns the query of a search request, made of the q and method form values,
+// and its options (see requestOptions).
+func searchRequest(r *http.Request, db *locate.DB) (q query, options *locate.Options, err error) {
+	q.Pattern = r.FormValue("q")
+	if q.Pattern == "" {
+		return q, nil, fmt.Errorf("missing q")
+	}
+
+	q.Methods = strings.Split(*searchMethod, ",")
+	if m := r.FormValue("method"); m != "" {
+		q.Methods = strings.Split(m, ",")
+	}
+	for _, m := range q.Methods {
+		if !locate.IsMethod(m) {
+			return q, nil, fmt.Errorf("no such search method as %s", m)
+		}
+	}
+
+	options, err = requestOptions(r, db)
+	return
+}
+
+// Handles /api/search?q=pattern[&method=m1,m2][&offset=n][&limit=n], along
+// with the toggles of requestOptions.
+// Methods are tried in order like on the command line, default is the -m flag.
+// Results are sorted, so that offset and limit can be used for pagination.
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	resp := &searchResponse{Query: r.FormValue("q"), Results: []Record{}}
+	fail := func(status int, err error) {
+		resp.Error = err.Error()
+		writeJSON(w, status, resp)
+	}
+
+	var err error
+	if resp.Offset, err = formUint(r, "offset", 0); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	if resp.Limit, err = formUint(r, "limit", 0); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	db := currentDB()
+	q, options, err := searchRequest(r, db)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	var matches []string
+	t0 := time.Now()
+	_, resp.Method, err = search(db, options, q, requestVisibility(r).filter(func(m string) {
+		matches = append(matches, m)
+	}))
+	resp.Elapsed = time.Now().Sub(t0).Seconds()
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	if len(matches) == 0 {
+		resp.Method = ""
+	}
+
+	sort.Strings(matches)
+	resp.Total = len(matches)
+	if resp.Offset < len(matches) {
+		matches = matches[resp.Offset:]
+	} else {
+		matches = nil
+	}
+	if resp.Limit > 0 && resp.Limit < len(matches) {
+		matches = matches[:resp.Limit]
+	}
+	for _, m := range matches {
+		resp.Results = append(resp.Results, Record{Path: m})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Handles /api/reload, which reads the databases anew (POST only).
+// Only authenticated clients can reload, so the endpoint is disabled without
+// -tokens, and reloads are no more frequent than reloadInterval.
+func apiReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
+	}
+	if tokens == nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "reloading over HTTP requires -tokens, send SIGHUP instead"})
+		return
+	}
+
+	t0 := time.Now()
+	wait, err := reloadDBThrottled()
+	if wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "reloaded less than " + reloadInterval().String() + " ago"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"files": currentDB().Len(), "elapsed": time.Now().Sub(t0).Seconds()})
+}
+
+// Idle keep-alive connections are closed after this long.
+const idleTimeout = 2 * time.Minute
+
+// Returns the HTTP server of the daemon, see runDaemon.
+func newHTTPServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	static, _ := fs.Sub(webFS, "web")
+	mux.Handle("/static/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/api/config", configHandler)
+	mux.HandleFunc("/api/search", apiSearchHandler)
+	mux.HandleFunc("/api/stream", apiStreamHandler)
+	mux.HandleFunc("/api/reload", apiReloadHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           authHandler(mux),
+		ReadHeaderTimeout: *readTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+// Metrics of the daemon, served at /metrics in the Prometheus text format.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the search latency histogram buckets, in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+type histogram struct {
+	counts []uint64 // Observations in each bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+var metrics struct {
+	sync.Mutex
+	queries     map[string]uint64     // Queries served, by the method that found the matches
+	searches    map[string]*histogram // Database scans, by method
+	cacheHits   uint64
+	cacheMisses uint64
+	reloads     uint64
+}
+
+// Counts a query served, from the cache or not.
+func countQuery(method string, matches int, cached bool) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if matches == 0 {
+		method = "none"
+	}
+	if metrics.queries == nil {
+		metrics.queries = make(map[string]uint64)
+	}
+	metrics.queries[method]++
+	if cached {
+		metrics.cacheHits++
+	} else if cache != nil {
+		metrics.cacheMisses++
+	}
+}
+
+// Records the time a search in the databases took.
+func countSearch(method string, d time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if metrics.searches == nil {
+		metrics.searches = make(map[string]*histogram)
+	}
+	h, ok := metrics.searches[method]
+	if !ok {
+		h = new(histogram)
+		metrics.searches[method] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func countReload() {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.reloads++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("xlocate_queries_total", "counter", "Queries served, by the search method that found the matches (none if there were none).")
+	var methods []string
+	for m := range metrics.queries {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		fmt.Fprintf(w, "xlocate_queries_total{method=\"%s\"} %d\n", m, metrics.queries[m])
+	}
+
+	header("xlocate_search_duration_seconds", "histogram", "Time spent searching the databases, by search method. Cached queries aren't counted.")
+	methods = methods[:0]
+	for m := range metrics.searches {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		h := metrics.searches[m]
+		cumulative := uint64(0)
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "xlocate_search_duration_seconds_bucket{method=\"%s\",le=\"%g\"} %d\n", m, le, cumulative)
+		}
+		fmt.Fprintf(w, "xlocate_search_duration_seconds_bucket{method=\"%s\",le=\"+Inf\"} %d\n", m, h.count)
+		fmt.Fprintf(w, "xlocate_search_duration_seconds_sum{method=\"%s\"} %g\n", m, h.sum)
+		fmt.Fprintf(w, "xlocate_search_duration_seconds_count{method=\"%s\"} %d\n", m, h.count)
+	}
+
+	header("xlocate_cache_hits_total", "counter", "Queries answered from the cache.")
+	fmt.Fprintf(w, "xlocate_cache_hits_total %d\n", metrics.cacheHits)
+	header("xlocate_cache_misses_total", "counter", "Queries not found in the cache.")
+	fmt.Fprintf(w, "xlocate_cache_misses_total %d\n", metrics.cacheMisses)
+	header("xlocate_cache_entries", "gauge", "Queries in the cache.")
+	fmt.Fprintf(w, "xlocate_cache_entries %d\n", cache.len())
+
+	header("xlocate_db_reloads_total", "counter", "Successful reloads of the databases.")
+	fmt.Fprintf(w, "xlocate_db_reloads_total %d\n", metrics.reloads)
+
+	db := currentDB()
+	if db == nil {
+		return
+	}
+	header("xlocate_db_entries", "gauge", "Files in use from all the databases.")
+	fmt.Fprintf(w, "xlocate_db_entries %d\n", db.Len())
+
+	header("xlocate_db_files", "gauge", "Files listed in each database file.")
+	for _, st := range db.Stats() {
+		fmt.Fprintf(w, "xlocate_db_files{db=\"%s\"} %d\n", labelEscaper.Replace(st.Filename), st.Files)
+	}
+	header("xlocate_db_size_bytes", "gauge", "Size of each database file.")
+	for _, st := range db.Stats() {
+		fmt.Fprintf(w, "xlocate_db_size_bytes{db=\"%s\"} %d\n", labelEscaper.Replace(st.Filename), st.Size)
+	}
+	header("xlocate_db_load_seconds", "gauge", "Time it took to read each database file.")
+	for _, st := range db.Stats() {
+		fmt.Fprintf(w, "xlocate_db_load_seconds{db=\"%s\"} %g\n", labelEscaper.Replace(st.Filename), st.LoadTime.Seconds())
+	}
+}
+
+// Handles /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
@@ -0,0 +1,127 @@
+package main
+
+// Reloading the databases of a running daemon.
+// A new DB is read in the background and swapped in when it's ready; searches
+// in progress go on with the old one. Cached results are dropped.
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	. "symutils/common"
+	"symutils/locate"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	reloadLock sync.Mutex // One reload at a time
+	lastReload time.Time  // When the databases were last reloaded, guarded by reloadLock
+)
+
+// Reads the databases anew and replaces the ones in use.
+// On errors, the old databases are kept.
+func reloadDB() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return reload()
+}
+
+// Minimum time between reloads requested over HTTP: the -watch interval, or
+// a minute if the databases aren't watched.
+func reloadInterval() time.Duration {
+	if *watchInterval > 0 {
+		return *watchInterval
+	}
+	return time.Minute
+}
+
+// Like reloadDB, but doesn't reload within reloadInterval of the last
+// reload, returning how long to wait instead.
+func reloadDBThrottled() (wait time.Duration, err error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if since := time.Now().Sub(lastReload); since < reloadInterval() {
+		return reloadInterval() - since, nil
+	}
+	return 0, reload()
+}
+
+// Does the reloading, reloadLock must be held.
+func reload() error {
+	lastReload = time.Now()
+	t0 := time.Now()
+	db, err := locate.NewDB(strings.Split(*dbFiles, ":"), &dbOptions)
+	if err != nil {
+		return err
+	}
+	dbValue.Store(db)
+	cache.reset()
+	countReload()
+	Logln("Reloaded", *dbFiles, "in", float64(time.Now().Sub(t0))/1e9, "seconds")
+	return nil
+}
+
+// Identifies a version of a database file.
+type dbStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+func dbStamps() []dbStamp {
+	var stamps []dbStamp
+	for _, f := range strings.Split(*dbFiles, ":") {
+		var st dbStamp
+		if fi, err := os.Stat(f); err == nil {
+			st = dbStamp{fi.ModTime(), fi.Size()}
+		}
+		stamps = append(stamps, st)
+	}
+	return stamps
+}
+
+func sameStamps(a, b []dbStamp) bool {
+	for i := range a {
+		if !a[i].mtime.Equal(b[i].mtime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the database files every interval, and reloads them once they
+// change (updatedb(8) replaces them by renaming a temporary file, so there's
+// no need to wait for it to finish writing).
+func watchDB(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	stamps := dbStamps()
+	for _ = range time.Tick(interval) {
+		now := dbStamps()
+		if sameStamps(stamps, now) {
+			continue
+		}
+
+		Logln("Databases changed, reloading")
+		if err := reloadDB(); err != nil {
+			Warnln(err) // We'll try again at the next tick
+			continue
+		}
+		stamps = now
+	}
+}
+
+// Reloads the databases on SIGHUP.
+func reloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for _ = range ch {
+		if err := reloadDB(); err != nil {
+			Warnln(err)
+		}
+	}
+}
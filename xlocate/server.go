@@ -0,0 +1,129 @@
+package main
+
+// Lifecycle of the daemon: listening, readiness notification, and graceful
+// shutdown on SIGTERM or SIGINT, letting searches in progress finish.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	. "symutils/common"
+	"sync"
+	"syscall"
+)
+
+// Runs the HTTP service and/or the socket daemon until a signal or a fatal
+// error, then exits.
+func runDaemon() {
+	errc := make(chan error, 1)
+
+	var srv *http.Server
+	if *httpAddr != "" {
+		l, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			Errorln(err)
+		}
+		srv = newHTTPServer(*httpAddr)
+		Logln("Serving HTTP on", l.Addr())
+		go func() {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	}
+
+	var sock net.Listener
+	var conns sync.WaitGroup // Socket connections being served
+	if *daemon {
+		var err error
+		if sock, err = listenUnix(*socketPath); err != nil {
+			Errorln(err)
+		}
+		go serveSocket(sock, &conns)
+	}
+
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			Errorln(err)
+		}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		Warnln("sd_notify:", err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	status := 0
+	select {
+	case s := <-sig:
+		Logln("Received", s, "- shutting down")
+	case err := <-errc:
+		// Not Errorln, which would exit without shutting down
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+	}
+	signal.Stop(sig)
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if sock != nil {
+		sock.Close() // Removes the socket file as well
+	}
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			Warnln("Searches still in progress, stopping anyway:", err)
+			srv.Close()
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		Warnln("Socket connections still open, stopping anyway")
+	}
+
+	if *pidFile != "" {
+		os.Remove(*pidFile)
+	}
+	os.Exit(status)
+}
+
+// Writes our process ID to path, replacing the file atomically.
+func writePidFile(path string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintln(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Sends state to the service manager as sd_notify(3) does, if we were
+// started with $NOTIFY_SOCKET (e.g. by systemd for Type=notify services).
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // Abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
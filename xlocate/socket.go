@@ -0,0 +1,259 @@
+package main
+
+// xlocate daemon serving searches on a Unix socket, and the client side of it.
+//
+// The client sends a single JSON encoded request. The daemon replies with one
+// JSON object per line: one for each match, and a final one with Done set,
+// carrying the error if there's any.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	. "symutils/common"
+	"symutils/locate"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A search request sent to the daemon.
+type request struct {
+	Queries []query
+	All     bool // Match all the queries, rather than any
+	Limit   uint // Maximum number of matches to send back, zero means no limit
+	DBFiles string
+	Options locate.Options // Must match the daemon's, see sameOptions
+}
+
+// A line of the daemon's reply.
+type response struct {
+	Path    string `json:",omitempty"`
+	Done    bool   `json:",omitempty"` // Last line of the reply
+	Refused bool   `json:",omitempty"` // The daemon can't serve the request, search locally instead
+	Error   string `json:",omitempty"`
+}
+
+var errOptions = errors.New("database options differ from the daemon's")
+
+// Default socket of the daemon: xlocate.sock under $XDG_RUNTIME_DIR, or a
+// per-user socket in the temporary directory.
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "xlocate.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("xlocate-%d.sock", os.Getuid()))
+}
+
+// Reports whether the daemon's databases, searched with its options, give the
+// same results the client would get by reading the databases itself.
+func sameOptions(req *request) bool {
+	// Options that don't affect the results
+	normalize := func(o locate.Options) locate.Options {
+		o.MaxMatches, o.NWorkers, o.HashMap = 0, 0, false
+		o.Root = filepath.Clean(o.Root)
+		return o
+	}
+	return req.DBFiles == *dbFiles && normalize(req.Options) == normalize(dbOptions)
+}
+
+// Listens on a Unix socket with the permissions given by -socketmode.
+// A stale socket left behind by a dead daemon is removed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	mask := syscall.Umask(0177) // Don't let anyone in before chmod
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, os.FileMode(*socketMode)&os.ModePerm); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serves searches on l until it's closed. conns counts the connections being
+// served.
+func serveSocket(l net.Listener, conns *sync.WaitGroup) {
+	Logln("Serving on", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			Warnln(err)
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			serveConn(conn)
+		}()
+	}
+}
+
+// Serves a single request on conn. Reading the request is limited by
+// -readtimeout, and the rest by -writetimeout. The search is given up if the
+// client goes away, or the reply can't be written.
+func serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+
+	if *readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(*readTimeout))
+	}
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		enc.Encode(&response{Done: true, Error: err.Error()})
+		return
+	}
+
+	deadline := time.Time{}
+	if *writeTimeout > 0 {
+		deadline = time.Now().Add(*writeTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// The client sends nothing after the request: the read returns
+		// when the client closes the connection, the deadline passes, or
+		// we're done and close it ourselves.
+		var b [1]byte
+		conn.Read(b[:])
+		cancel()
+	}()
+
+	if !sameOptions(&req) {
+		enc.Encode(&response{Done: true, Refused: true, Error: errOptions.Error()})
+		return
+	}
+	for _, q := range req.Queries {
+		for _, m := range q.Methods {
+			if !locate.IsMethod(m) {
+				enc.Encode(&response{Done: true, Error: "No such search method as " + m})
+				return
+			}
+		}
+	}
+
+	vis, err := connVisibility(conn)
+	if err != nil {
+		enc.Encode(&response{Done: true, Error: err.Error()})
+		return
+	}
+
+	n := uint(0)
+	err = searchAllContext(ctx, currentDB(), req.Queries, req.All, vis.filter(func(m string) {
+		if req.Limit > 0 && n >= req.Limit {
+			return
+		}
+		n++
+		if err := enc.Encode(&response{Path: m}); err != nil {
+			cancel()
+		}
+	}))
+	if ctx.Err() != nil {
+		return // Nobody to reply to
+	}
+
+	resp := &response{Done: true}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	enc.Encode(resp)
+}
+
+// Reports whether a socket can be trusted to deliver genuine results:
+// the socket has been given explicitly with -socket, or it's owned by root
+// or us.
+func trustedSocket(path string, fi os.FileInfo) bool {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "socket" {
+			explicit = true
+		}
+	})
+	uid := int(fi.Sys().(*syscall.Stat_t).Uid)
+	return explicit || uid == 0 || uid == os.Getuid()
+}
+
+// Sends the queries to the daemon listening on the socket, and passes the
+// matches to fn.
+// Returns false if there's no daemon, or it can't serve the request, in which
+// case the caller should search the databases itself.
+func runClient(path string, fn func(string)) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	if !trustedSocket(path, fi) {
+		Warnf("Ignoring daemon socket %s owned by another user\n", path)
+		return false
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		Logln(err)
+		return false
+	}
+	defer conn.Close()
+
+	req := &request{Queries: queries, All: *matchAll, Limit: *limit, DBFiles: *dbFiles, Options: dbOptions}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		Warnln(err)
+		return false
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for n := 0; ; n++ {
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			if n == 0 { // Nothing's been written yet, we can still fall back
+				Warnln("daemon:", err)
+				return false
+			}
+			Errorln("daemon:", err)
+		}
+
+		if resp.Done {
+			if resp.Refused {
+				Logln("daemon:", resp.Error)
+				return false
+			}
+			if resp.Error != "" {
+				Errorln(resp.Error)
+			}
+			Logln("Searched through the daemon at", path)
+			return true
+		}
+		fn(resp.Path)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+// Streaming search: /api/stream sends matches as they are found, either as
+// server-sent events or as newline delimited JSON, with progress reports.
+// The search is cancelled when the client goes away.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	. "symutils/common"
+	"symutils/locate"
+	"time"
+)
+
+const (
+	// Interval between progress reports, which also flush the pending matches.
+	progressInterval = 250 * time.Millisecond
+	// A stream that can't be written for this long is dropped.
+	streamWriteTimeout = 30 * time.Second
+)
+
+// An event of the stream.
+type streamEvent struct {
+	Type    string  `json:"type"`              // "match", "progress" or "done"
+	Path    string  `json:"path,omitempty"`    // Matching file, for match events
+	Method  string  `json:"method,omitempty"`  // Method that found the matches, when done
+	Scanned int     `json:"scanned,omitempty"` // Database entries examined by the method
+	Total   int     `json:"total,omitempty"`   // Database entries to examine
+	Matches int     `json:"matches"`           // Matches sent so far
+	Elapsed float64 `json:"elapsed,omitempty"` // Search time in seconds, when done
+	Error   string  `json:"error,omitempty"`
+}
+
+// Writes events as server-sent events (SSE) or as JSON lines.
+type streamWriter struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	sse bool
+	err error // First write error, usually because the client went away
+}
+
+func (sw *streamWriter) write(ev *streamEvent) {
+	if sw.err != nil {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		sw.err = err
+		return
+	}
+	if sw.sse {
+		_, sw.err = fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", ev.Type, b)
+	} else {
+		_, sw.err = fmt.Fprintf(sw.w, "%s\n", b)
+	}
+}
+
+// Flushes the pending events, and gives the client streamWriteTimeout to take
+// the next ones.
+func (sw *streamWriter) flush() {
+	if sw.err == nil {
+		sw.err = sw.rc.Flush()
+	}
+	if sw.err == nil {
+		sw.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	}
+}
+
+// Handles /api/stream, which takes the same parameters as /api/search but
+// offset. Matches come in the order they are found, with a progress event
+// every progressInterval and a done event at the end. -writetimeout doesn't
+// apply, but a client that stops reading is dropped after streamWriteTimeout.
+// The stream is made of server-sent events with format=sse, or if the client
+// accepts text/event-stream only; otherwise of JSON lines.
+func apiStreamHandler(w http.ResponseWriter, r *http.Request) {
+	sse := r.FormValue("format") == "sse" || r.Header.Get("Accept") == "text/event-stream"
+
+	db := currentDB()
+	q, options, err := searchRequest(r, db)
+	var limit int
+	if err == nil {
+		limit, err = formUint(r, "limit", 0)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &streamEvent{Type: "done", Error: err.Error()})
+		return
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	sw := &streamWriter{w: w, rc: http.NewResponseController(w), sse: sse}
+	// Streams may last longer than -writetimeout, as long as they move
+	sw.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+	// Cancelled when the client goes away, when limit is reached, or when
+	// the stream can't be written anymore.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var (
+		progress locate.Progress
+		method   string
+		t0       = time.Now()
+	)
+	matches := make(chan string)
+	go func() {
+		defer close(matches)
+		_, method, err = searchContext(ctx, db, options, q, &progress, requestVisibility(r).filter(func(m string) {
+			select {
+			case matches <- m:
+			case <-ctx.Done():
+			}
+		}))
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	n := 0
+	for matches != nil {
+		select {
+		case m, ok := <-matches:
+			if !ok {
+				matches = nil
+				break
+			}
+			if limit > 0 && n >= limit {
+				break // Cancelled, waiting for the search to stop
+			}
+			n++
+			sw.write(&streamEvent{Type: "match", Path: m, Matches: n})
+			if n == limit {
+				cancel()
+			}
+		case <-ticker.C:
+			sw.write(&streamEvent{Type: "progress", Scanned: progress.Scanned(), Total: progress.Total(), Matches: n})
+			sw.flush()
+		}
+		if sw.err != nil {
+			cancel()
+		}
+	}
+
+	// The search goroutine is done with method and err once matches is closed
+	if r.Context().Err() != nil {
+		Logf("stream of %s cancelled after %d matches\n", q.Pattern, n)
+		return
+	}
+	done := &streamEvent{Type: "done", Matches: n, Elapsed: time.Now().Sub(t0).Seconds()}
+	if n > 0 {
+		done.Method = method
+	}
+	if err != nil && err != context.Canceled {
+		done.Error = err.Error()
+	}
+	sw.write(done)
+	sw.flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+// Templates for the results: HTML ones for the HTTP service (-template), and
+// text ones for plain output (-texttemplate).
+
+import (
+	htmltemplate "html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"symutils/fuzzy"
+	"symutils/locate"
+	texttemplate "text/template"
+	"time"
+)
+
+var (
+	htmlTpl *htmltemplate.Template
+	textTpl *texttemplate.Template
+)
+
+// A match, as seen by the templates.
+type Match struct {
+	N       int              // Position of the match in the results, starting from 1
+	Path    string           // Full path of the file
+	Base    string           // Base name of the file
+	Dir     string           // Directory of the file
+	URL     htmltemplate.URL // file:// URL of the file, with the path escaped
+	Size    int64            // Size of the file in bytes, zero if it doesn't exist
+	Mode    os.FileMode
+	ModTime time.Time // Modification time of the file, zero if it doesn't exist
+	DB      string    // Database file listing the file
+	Score   int       // Levenshtein distance of the pattern to the base name as in -m levenshtein, lower is closer
+}
+
+// Distances are counted in single character edits.
+var scoreCost = fuzzy.LevenshteinCost{Del: 1, Ins: 1, Subs: 1}
+
+// Makes the nth Match for path, found in db searching for patterns.
+// db is nil when searching through the daemon. Score is relative to the
+// closest pattern.
+func newMatch(n int, path string, db *locate.DB, patterns []string) *Match {
+	m := &Match{
+		N:    n,
+		Path: path,
+		Base: filepath.Base(path),
+		Dir:  filepath.Dir(path),
+		URL:  htmltemplate.URL((&url.URL{Scheme: "file", Path: path}).String()),
+	}
+	if db != nil {
+		m.DB = db.Source(path)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		m.Size, m.Mode, m.ModTime = fi.Size(), fi.Mode(), fi.ModTime()
+	}
+
+	for i, p := range patterns {
+		score := fuzzy.Levenshtein(filepath.Base(p), m.Base, &scoreCost)
+		if i == 0 || score < m.Score {
+			m.Score = score
+		}
+	}
+	return m
+}
+
+// Parses the -template and -texttemplate flags. Each result is followed by a
+// newline. Without -texttemplate, the text template lists paths only.
+func parseTemplates() error {
+	var err error
+	if htmlTpl, err = htmltemplate.New("result").Parse(*templateString + "\n"); err != nil {
+		return err
+	}
+
+	text := *textTemplateString
+	if text == "" {
+		text = "{{.Path}}"
+	}
+	textTpl, err = texttemplate.New("result").Parse(text + "\n")
+	return err
+}
@@ -0,0 +1,106 @@
+// Web UI of the xlocate daemon, a front-end to /api/search.
+(function() {
+	"use strict";
+
+	var form = document.getElementById("search"),
+		method = document.getElementById("method"),
+		status = document.getElementById("status"),
+		results = document.getElementById("results"),
+		pages = document.getElementById("pages"),
+		offset = 0;
+
+	function setStatus(text, isError) {
+		status.textContent = text;
+		status.className = isError ? "error" : "";
+	}
+
+	// Fills the method selection and the toggles from the daemon's configuration.
+	function loadConfig() {
+		fetch("/api/config").then(function(r) { return r.json(); }).then(function(c) {
+			method.options[0].textContent = "default (" + c.SearchMethod + ")";
+			c.Methods.forEach(function(m) {
+				var o = document.createElement("option");
+				o.value = o.textContent = m;
+				method.appendChild(o);
+			});
+			form.icase.checked = c.IgnoreCase;
+			form.basename.checked = c.StripPath;
+			form.existing.checked = c.Existing;
+			form.follow.checked = c.Follow;
+			form.symlinks.checked = c.SymlinkCandidates;
+		});
+	}
+
+	function query() {
+		var p = new URLSearchParams();
+		p.set("q", form.q.value);
+		if (method.value) {
+			p.set("method", method.value);
+		}
+		["icase", "basename", "existing", "follow", "symlinks"].forEach(function(name) {
+			p.set(name, form[name].checked ? "1" : "0");
+		});
+		p.set("offset", offset);
+		p.set("limit", form.limit.value);
+		return p;
+	}
+
+	function show(resp) {
+		results.textContent = "";
+		results.start = resp.offset + 1;
+		resp.results.forEach(function(r) {
+			var li = document.createElement("li"),
+				a = document.createElement("a"),
+				slash = r.path.lastIndexOf("/"),
+				dir = document.createElement("span");
+			dir.className = "dir";
+			dir.textContent = r.path.slice(0, slash + 1);
+			a.href = "file://" + r.path.split("/").map(encodeURIComponent).join("/");
+			a.textContent = r.path.slice(slash + 1);
+			li.appendChild(dir);
+			li.appendChild(a);
+			results.appendChild(li);
+		});
+
+		if (resp.total === 0) {
+			setStatus("No matches.");
+		} else {
+			setStatus(resp.total + " matches using " + resp.method + " in " + resp.elapsed.toFixed(3) + " seconds.");
+		}
+
+		var limit = resp.limit, npages = Math.ceil(resp.total / limit);
+		pages.style.display = npages > 1 ? "block" : "none";
+		document.getElementById("page").textContent = "Page " + (Math.floor(resp.offset / limit) + 1) + " of " + npages;
+		document.getElementById("prev").disabled = resp.offset === 0;
+		document.getElementById("next").disabled = resp.offset + limit >= resp.total;
+	}
+
+	function search() {
+		setStatus("Searching...");
+		fetch("/api/search?" + query()).then(function(r) { return r.json(); }).then(function(resp) {
+			if (resp.error) {
+				setStatus(resp.error, true);
+				return;
+			}
+			show(resp);
+		}).catch(function(err) {
+			setStatus(err, true);
+		});
+	}
+
+	form.addEventListener("submit", function(e) {
+		e.preventDefault();
+		offset = 0;
+		search();
+	});
+	document.getElementById("prev").addEventListener("click", function() {
+		offset = Math.max(0, offset - Number(form.limit.value));
+		search();
+	});
+	document.getElementById("next").addEventListener("click", function() {
+		offset += Number(form.limit.value);
+		search();
+	});
+
+	loadConfig();
+})();
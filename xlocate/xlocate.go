@@ -25,18 +25,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	. "symutils/common"
 	"symutils/fuzzy"
 	"symutils/locate"
-	"text/template"
+	"sync/atomic"
 	"time"
 )
 
@@ -46,10 +45,10 @@ const (
 
 var (
 	stripPath    = flag.Bool("b", false, "Match only the basename part of files, stripping the path.")
-	countEntries = flag.Bool("c", false, "Write out the number of matching entries and quit.")
+	countEntries = flag.Bool("c", false, "Write out the number of matching entries instead of the entries themselves, and quit.")
 	dbFiles      = flag.String("d", DBFILES, "List of : separated database files. xlocate will try to determine the format automatically.")
 	existing     = flag.Bool("e", false, "List only existing files.")
-	follow       = flag.Bool("f", false, "Follow symlinks when checking for existence.")
+	follow       = flag.Bool("f", false, "Follow symlinks when checking for existence (with -e), dropping dangling and looping symlinks.")
 	ignoreCase   = flag.Bool("i", false, "Ignore case.")
 	showHelp     = flag.Bool("h", false, "Display help and quit")
 	limit        = flag.Uint("l", 0, "Limit the number of listed entries, zero means no limit.")
@@ -64,37 +63,94 @@ var (
 	stripExtension    = flag.Bool("E", false, "Ignore file extension. (For definition of extension, see Go's package documentation on filepath.Ext)")
 	basenameMustMatch = flag.Bool("B", false, "Basename must match (this's slightly different than the GNU Locate's -b option).")
 
-	symlinkCandidates = flag.Bool("s", true, "List symlinks") //FIXME: What about S in GNU locate?
-	showVersion       = flag.Bool("V", false, "Display version and licensing information, and quit.")
-	httpAddr          = flag.String("http", "", "HTTP service address (eg. ':9188')")
-	templateString    = flag.String("template", `{{.N}}. <a href="file://{{.Path}}">{{.Base}}</a><br>`, "Template for HTTP results")
+	symlinkCandidates  = flag.Bool("s", true, "List symlinks") //FIXME: What about S in GNU locate?
+	showVersion        = flag.Bool("V", false, "Display version and licensing information, and quit.")
+	nullSep            = flag.Bool("0", false, "Separate entries with NUL instead of newline on output.")
+	outputFormat       = flag.String("format", "plain", OutputFormatUsage)
+	statistics         = flag.Bool("S", false, "Print statistics (format, number of directories and files, size, load time) about each database instead of searching, and quit.")
+	batch              = flag.Bool("batch", false, "Read patterns from standard input, one per line (NUL separated with -0), and list the matches of each, followed by an empty entry. With -format json, write one object per pattern. The databases are read only once.")
+	matchAll           = flag.Bool("A", false, "List only entries matching all the given patterns, rather than any of them.")
+	httpAddr           = flag.String("http", "", "HTTP service address (eg. ':9188')")
+	daemon             = flag.Bool("daemon", false, "Run as a daemon, serving searches on the Unix socket given by -socket. Can be combined with -http.")
+	socketPath         = flag.String("socket", defaultSocket(), "Unix socket of the xlocate daemon. If a daemon is listening on it, xlocate sends its searches to the daemon instead of reading the databases.")
+	socketMode         = flag.Uint("socketmode", 0600, "Permissions of the daemon's socket, e.g. 0666 to let every user search through the daemon.")
+	local              = flag.Bool("local", false, "Read the databases even if a daemon is running.")
+	tokensFile         = flag.String("tokens", "", "File of 'token user' lines. If given, HTTP requests must carry one of the tokens (as a bearer token, or as the password of basic authentication for that user), and see only the paths that user can access. /api/reload is available only with tokens.")
+	peerFilter         = flag.Bool("peerfilter", true, "Let clients of the daemon's socket see only the paths they can access themselves, using the peer credentials of the connection.")
+	cacheSize          = flag.Uint("cache", 256, "Number of query results the daemon keeps in memory, zero disables caching. The cache is emptied when the databases are reloaded. Searches with -e aren't cached, their results depending on the files present.")
+	watchInterval      = flag.Duration("watch", time.Minute, "How often the daemon checks the databases for changes, and reloads them. Zero disables it; the daemon also reloads on SIGHUP.")
+	readTimeout        = flag.Duration("readtimeout", 10*time.Second, "Time limit for reading an HTTP request, or a request on the daemon's socket.")
+	writeTimeout       = flag.Duration("writetimeout", 5*time.Minute, "Time limit for an HTTP or socket request, from the end of reading it to the end of the response, searching included. Zero means no limit. Doesn't apply to /api/stream, which is dropped only once the client stops reading for 30s.")
+	shutdownTimeout    = flag.Duration("shutdowntimeout", 30*time.Second, "How long the daemon waits for searches in progress when stopped by SIGTERM or SIGINT.")
+	pidFile            = flag.String("pidfile", "", "File the daemon writes its process ID to once it's ready to serve, removed on exit. The daemon also notifies systemd (Type=notify) when $NOTIFY_SOCKET is set.")
+	templateString     = flag.String("template", `{{.N}}. <a href="{{.URL}}">{{.Base}}</a><br>`, "HTML template (see Go's html/template) for HTTP results. Fields: N, Path, Base, Dir, URL, Size, Mode, ModTime, DB, Score (see the Match type).")
+	textTemplateString = flag.String("texttemplate", "", "Text template (see Go's text/template) for plain output, on the command line (instead of -format) and for HTTP results requested with ?format=text. Fields are the same as for -template.")
 
 	verbose = flag.Uint("v", 0, "Verbosity 0: errors only, 1: errors and warnings, 2: errors, warning, log")
 )
 
 var (
-	db  *locate.DB
-	tpl *template.Template
+	dbValue   atomic.Value // *locate.DB in use, see currentDB
+	dbOptions locate.Options
+	out       *Output
 )
 
 const (
 	pkg, version, author, about, usage string = "xlocate", VERSION, "Utkan Güngördü",
 		"xlocate(1) A feature-richer, parallel alternative to locate(1).",
-		"xlocate [options] pattern"
+		"xlocate [options] pattern [pattern...]\n\t xlocate --gnu [GNU locate options] pattern... (also used when invoked as locate)"
 )
 
-func init() {
-	flag.Parse()
+// A query is a pattern along with the search methods to try on it, in order.
+// The next method is tried only if the previous one gives no hits.
+type query struct {
+	Pattern string
+	Methods []string
+}
+
+var queries []query
+
+// Parses the command line, and sets up what it asks for. Called from main
+// rather than init, so that the tests can run without arguments.
+func setup() {
+	if gnuInvocation() {
+		initGNU()
+	} else {
+		flag.Parse()
+
+		SetLogLevel(*verbose)
+
+		daemonMode := *httpAddr != "" || *daemon
 
-	SetLogLevel(*verbose)
+		if *showVersion {
+			PrintVersion(pkg, version, author)
+			os.Exit(0)
+		}
+		if *showHelp || (!daemonMode && !*statistics && !*batch && flag.NArg() == 0) {
+			PrintHelp(pkg, version, about, usage)
+			os.Exit(0)
+		}
+
+		methods := strings.Split(*searchMethod, ",")
+		for _, pattern := range flag.Args() {
+			queries = append(queries, query{Pattern: pattern, Methods: methods})
+		}
+	}
 
-	daemonMode := *httpAddr != ""
+	if err := parseTemplates(); err != nil {
+		Errorln(err)
+	}
 
-	if *showHelp || (!daemonMode && flag.NArg() == 0) {
-		PrintHelp(pkg, version, about, usage)
-		os.Exit(0)
+	var err error
+	if out, err = NewOutput(os.Stdout, *outputFormat, *nullSep); err != nil {
+		Errorln(err)
 	}
 
+	dbOptions = flagOptions()
+}
+
+// Returns the search options given by the flags, exits on errors.
+func flagOptions() locate.Options {
 	var fuzzyCost fuzzy.LevenshteinCost
 	var fuzzyThreshold int
 
@@ -108,15 +164,19 @@ func init() {
 		}
 	}
 
-	tpl = template.Must(template.New("result").Parse(*templateString + "\n"))
+	maxMatches := *limit
+	if *matchAll {
+		maxMatches = 0 // The limit applies to the intersection, see main.
+	}
 
-	options := locate.Options{
+	return locate.Options{
 		IgnoreCase:           *ignoreCase,
-		MaxMatches:           *limit,
+		MaxMatches:           maxMatches,
 		StripExtension:       *stripExtension,
 		Basename:             *basenameMustMatch,
 		StripPath:            *stripPath,
 		Existing:             *existing, // We handle this manually, after getting the list of matches.
+		Follow:               *follow,
 		Accessable:           *accessable,
 		Symlink:              *symlinkCandidates,
 		HashMap:              strings.Contains(*searchMethod, "hashmap"),
@@ -125,126 +185,258 @@ func init() {
 		NWorkers:             *nworkers,
 		Root:                 *root,
 	}
+}
 
-	var err error
+// Reads the databases, exits on errors.
+func loadDB() {
 	t0 := time.Now()
-	db, err = locate.NewDB(strings.Split(*dbFiles, ":"), &options)
+	db, err := locate.NewDB(strings.Split(*dbFiles, ":"), &dbOptions)
 	t1 := time.Now()
 	Logln("Loaded", *dbFiles, "in", float64(t1.Sub(t0))/1e9, "seconds")
 	if err != nil {
-		log.Fatal(err)
+		Errorln(err)
 	}
+	dbValue.Store(db)
 }
 
-type Config struct {
-	StripPath         bool
-	CountEntries      bool
-	DBFiles           string
-	Existing          bool
-	Follow            bool
-	IgnoreCase        bool
-	Limit             uint
-	Accessable        bool
-	LevenshteinParams string
-	SearchMethod      string
-	StripExtension    bool
-	BasenameMustMatch bool
-	SymlinkCandidates bool
-	HttpAddr          string
-	TemplateString    string
+// Returns the databases in use. The daemon may replace them at any time
+// (see reloadDB), so a search should call this only once.
+// Returns nil if the databases haven't been read.
+func currentDB() *locate.DB {
+	db, _ := dbValue.Load().(*locate.DB)
+	return db
 }
 
-func printConfig(w io.Writer) {
-	t := template.Must(template.ParseFiles("config.html"))
-	c := &Config{
-		StripPath:         *stripPath,
-		CountEntries:      *countEntries,
-		DBFiles:           *dbFiles,
-		Existing:          *existing,
-		Follow:            *follow,
-		IgnoreCase:        *ignoreCase,
-		Limit:             *limit,
-		Accessable:        *accessable,
-		LevenshteinParams: *levenshteinParams,
-		SearchMethod:      *searchMethod,
-		StripExtension:    *stripExtension,
-		BasenameMustMatch: *basenameMustMatch,
-		SymlinkCandidates: *symlinkCandidates,
-		HttpAddr:          *httpAddr,
-		TemplateString:    *templateString,
-	}
-	t.Execute(w, c)
+// Runs a single query, passing its matches to fn.
+// options override the DB's, if not nil.
+// Returns the number of matches, and the method that found them.
+func search(db *locate.DB, options *locate.Options, q query, fn func(string)) (n int, method string, err error) {
+	return searchContext(context.Background(), db, options, q, nil, fn)
 }
 
-type Match struct {
-	Base, Path string
-	N          int
-}
+// Like search, but gives up when ctx is done. progress, if not nil, follows
+// the method being tried. Results come from the cache when possible.
+func searchContext(ctx context.Context, db *locate.DB, options *locate.Options, q query, progress *locate.Progress, fn func(string)) (n int, method string, err error) {
+	if options == nil {
+		o := db.Options()
+		options = &o
+	}
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	pattern := r.URL.Path[1:]
+	// Results of -e depend on the files, which the cache doesn't keep track of
+	cache := cache
+	if options.Existing {
+		cache = nil
+	}
 
-	if pattern == "" {
-		printConfig(w)
-		return
+	key := cacheKey(q, options)
+	if e, ok := cache.get(db, key); ok {
+		for _, m := range e.matches {
+			fn(m)
+		}
+		countQuery(e.method, len(e.matches), true)
+		return len(e.matches), e.method, nil
 	}
 
-	w.Header().Set("Content-Type", "text/html")
+	var matches []string
+	defer func() {
+		if err != nil {
+			return
+		}
+		countQuery(method, n, false)
+		if n <= maxCachedMatches {
+			cache.add(&cacheEntry{key: key, db: db, method: method, matches: matches})
+		}
+	}()
 
-	nmatches := 0
-	for _, method := range strings.Split(*searchMethod, ",") {
-		var err error
+	for _, method = range q.Methods {
+		errc := make(chan error, 1)
 		ch := make(chan string)
-		go func() { err = locate.Locate(db, method, pattern, ch) }()
+		t0 := time.Now()
+		go func() { errc <- locate.LocateContext(ctx, db, method, q.Pattern, ch, options, progress) }()
 
-		for p := range ch {
-			nmatches++
-			m := &Match{Path: p, Base: filepath.Base(p), N: nmatches}
-			tpl.Execute(w, m)
+		for m := range ch {
+			n++
+			if cache != nil && n <= maxCachedMatches {
+				matches = append(matches, m)
+			}
+			fn(m)
 		}
 
-		if err != nil {
-			fmt.Println(w, err)
+		err = <-errc
+		countSearch(method, time.Now().Sub(t0))
+		if err != nil || n > 0 {
 			return
 		}
-		if nmatches > 0 {
-			break
+	}
+	return
+}
+
+// Runs the queries, passing each matching file to fn only once.
+// A file matches if it matches any of the queries, or all of them if
+// all is set.
+func searchAll(db *locate.DB, queries []query, all bool, fn func(string)) error {
+	return searchAllContext(context.Background(), db, queries, all, fn)
+}
+
+// Like searchAll, but gives up when ctx is done.
+func searchAllContext(ctx context.Context, db *locate.DB, queries []query, all bool, fn func(string)) error {
+	if len(queries) == 1 {
+		_, _, err := searchContext(ctx, db, nil, queries[0], nil, fn)
+		return err
+	}
+
+	// Called for each match of the ith query, returns whether m is new.
+	var add func(i int, m string) bool
+	var order []string               // Candidates in the order they are found, when matching all the queries
+	nmatched := make(map[string]int) // The number of queries a file matched so far
+
+	if !all {
+		seen := make(map[string]struct{})
+		add = func(i int, m string) bool {
+			if _, ok := seen[m]; ok {
+				return false
+			}
+			seen[m] = struct{}{}
+			fn(m)
+			return true
+		}
+	} else {
+		add = func(i int, m string) bool {
+			if nmatched[m] != i {
+				return false
+			}
+			nmatched[m] = i + 1
+			if i == 0 {
+				order = append(order, m)
+			}
+			return true
 		}
 	}
+
+	for i, q := range queries {
+		nnew := 0
+		t0 := time.Now()
+		n, method, err := searchContext(ctx, db, nil, q, nil, func(m string) {
+			if add(i, m) {
+				nnew++
+			}
+		})
+		t1 := time.Now()
+		if err != nil {
+			return err
+		}
+		Logf("pattern %q: %d matches (%d new) using %s, %.3f seconds\n", q.Pattern, n, nnew, method, float64(t1.Sub(t0))/1e9)
+	}
+
+	for _, m := range order {
+		if nmatched[m] == len(queries) {
+			fn(m)
+		}
+	}
+	return nil
+}
+
+// Formats n with thousands separators, e.g. 12,345.
+func thousands(n int64) string {
+	if n < 0 {
+		return "-" + thousands(-n)
+	}
+	s := fmt.Sprint(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
 }
 
-func serveHTTP(addr string) {
-	http.HandleFunc("/", handler)
-	http.ListenAndServe(addr, nil)
+// Prints statistics about the databases in use, in the style of GNU locate.
+func printStatistics(w io.Writer) {
+	db := currentDB()
+	for _, st := range db.Stats() {
+		fmt.Fprintf(w, "Database %s is in the %s format.\n", st.Filename, st.Format)
+		if st.Root != "" {
+			fmt.Fprintf(w, "\t%s is the root directory\n", st.Root)
+		}
+		fmt.Fprintf(w, "\t%s directories\n", thousands(int64(st.Dirs)))
+		fmt.Fprintf(w, "\t%s files\n", thousands(int64(st.Files)))
+		fmt.Fprintf(w, "\t%s bytes in file names\n", thousands(st.PathBytes))
+		fmt.Fprintf(w, "\t%s bytes used to store database\n", thousands(st.Size))
+		fmt.Fprintf(w, "\tloaded in %.3f seconds\n", st.LoadTime.Seconds())
+	}
+	fmt.Fprintf(w, "%s file names under %s in total\n", thousands(int64(db.Len())), *root)
+}
+
+// Returns a function listing the matches it's given on w (with -texttemplate)
+// or out, counting them in n and stopping at -l. Nothing is listed with -c.
+func lister(w io.Writer, patterns []string, n *uint) func(string) {
+	return func(m string) {
+		if *limit > 0 && *n >= *limit {
+			return
+		}
+		*n++
+		switch {
+		case *countEntries:
+		case *textTemplateString != "":
+			textTpl.Execute(w, newMatch(int(*n), m, currentDB(), patterns))
+		default:
+			out.Write(Record{Path: m})
+		}
+	}
 }
 
 func main() {
-	if *httpAddr != "" {
-		serveHTTP(*httpAddr)
+	setup()
+
+	if *daemon || *httpAddr != "" {
+		if *tokensFile != "" {
+			var err error
+			if tokens, err = loadTokens(*tokensFile); err != nil {
+				Errorln(err)
+			}
+		}
+		cache = newResultCache(int(*cacheSize))
+		loadDB()
+		go watchDB(*watchInterval)
+		go reloadOnSignal()
+		runDaemon()
 		return
 	}
 
-	if flag.NArg() == 0 {
-		PrintHelp(pkg, version, about, usage)
-		os.Exit(0)
+	if *batch {
+		loadDB()
+		runBatch(os.Stdin)
+		return
 	}
 
-	nmatches := 0
-	for _, method := range strings.Split(*searchMethod, ",") {
-		var err error
-		ch := make(chan string)
-		go func() { err = locate.Locate(db, method, flag.Arg(0), ch) }()
+	var patterns []string
+	for _, q := range queries {
+		patterns = append(patterns, q.Pattern)
+	}
 
-		for m := range ch {
-			nmatches++
-			fmt.Println(m)
-		}
+	nmatches := uint(0)
+	emit := lister(os.Stdout, patterns, &nmatches)
 
-		if err != nil {
-			log.Fatal(err)
+	ok := false
+	if !*local && !*statistics {
+		ok = runClient(*socketPath, emit)
+	}
+	if !ok {
+		loadDB()
+
+		if *statistics {
+			printStatistics(os.Stdout)
+			return
 		}
-		if nmatches > 0 {
-			break
+
+		if err := searchAll(currentDB(), queries, *matchAll, emit); err != nil {
+			Errorln(err)
 		}
 	}
+
+	if *countEntries {
+		fmt.Println(nmatches)
+	}
+
+	if gnuMode && nmatches == 0 {
+		os.Exit(1)
+	}
 }